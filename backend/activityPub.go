@@ -0,0 +1,799 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"channel/activitypub"
+	"channel/markdown"
+)
+
+const (
+	activityPubPageSize     = 20
+	activityPubMaxAttempts  = 8
+	activityPubRetryBase    = time.Minute
+	activityPubRetryMax     = 12 * time.Hour
+	activityPubLease        = 2 * time.Minute
+	activityPubPollInterval = 10 * time.Second
+	activityPubBatchSize    = 20
+	activityPubMaxBodySize  = 1 << 20
+	activityPubActorTTL     = 24 * time.Hour
+
+	activityPubActorFailureTTL = 10 * time.Minute
+)
+
+// activityPubClient connects to URLs that remote servers choose, so it only
+// reaches public addresses, see activitypub.NewClient.
+var activityPubClient = activitypub.NewClient(10 * time.Second)
+
+var activityPubWake = make(chan struct{}, 1)
+
+var (
+	activityPubKeyMu sync.Mutex
+	activityPubKey   *rsa.PrivateKey
+)
+
+// Follower is a remote actor that follows the channel. Activities go to its
+// shared inbox when the server has one, so a server gets each post once.
+type Follower struct {
+	Actor       string    `json:"actor"`
+	Inbox       string    `json:"inbox"`
+	SharedInbox string    `json:"sharedInbox,omitempty"`
+	FollowedAt  time.Time `json:"followedAt"`
+}
+
+func (f *Follower) DeliveryInbox() string {
+	if f.SharedInbox != "" {
+		return f.SharedInbox
+	}
+	return f.Inbox
+}
+
+// ActivityPubDelivery is an activity waiting in the queue for one inbox.
+type ActivityPubDelivery struct {
+	ID            int64     `json:"id"`
+	Inbox         string    `json:"inbox"`
+	Activity      string    `json:"activity"`
+	Attempts      int       `json:"attempts"`
+	Error         string    `json:"error"`
+	CreatedAt     time.Time `json:"createdAt"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+}
+
+// activityPubEnabled reports whether the channel federates. Object IDs are
+// built from project_domain, so it must be set, and a channel that requires
+// auth is never published.
+func activityPubEnabled() bool {
+	return settingConfig.ActivityPubEnabled && !settingConfig.RequireAuth && projectURL() != ""
+}
+
+func ifActivityPubEnabled(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !activityPubEnabled() {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func activityPubActorURL() string {
+	return projectURL() + "/activitypub/actor"
+}
+
+func activityPubKeyId() string {
+	return activityPubActorURL() + "#main-key"
+}
+
+func activityPubNoteURL(id int) string {
+	return projectURL() + "/activitypub/messages/" + strconv.Itoa(id)
+}
+
+// getActivityPubKey returns the key of the actor, generating it on first use.
+// The key is kept for good, since followers cache it.
+func getActivityPubKey(ctx context.Context) (*rsa.PrivateKey, error) {
+	activityPubKeyMu.Lock()
+	defer activityPubKeyMu.Unlock()
+
+	if activityPubKey != nil {
+		return activityPubKey, nil
+	}
+
+	encoded, err := dbGetActivityPubKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if encoded == "" {
+		key, err := activitypub.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		if encoded, err = dbSetActivityPubKey(ctx, activitypub.EncodePrivateKey(key)); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := activitypub.ParsePrivateKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	activityPubKey = key
+
+	return key, nil
+}
+
+func writeActivityJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", activitypub.ContentType+"; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func getWebFinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+
+	base, _ := url.Parse(projectURL())
+	account := fmt.Sprintf("acct:%s@%s", settingConfig.ActivityPubUsername, base.Host)
+	if !strings.EqualFold(resource, account) && resource != activityPubActorURL() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	webFinger := activitypub.WebFinger{
+		Subject: account,
+		Aliases: []string{activityPubActorURL()},
+		Links: []activitypub.WebFingerLink{
+			{Rel: "self", Type: activitypub.ContentType, Href: activityPubActorURL()},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: projectURL() + "/"},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json")
+	json.NewEncoder(w).Encode(webFinger)
+}
+
+func getActivityPubActor(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := getChannelDetails(ctx)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	key, err := getActivityPubKey(ctx)
+	if err != nil {
+		log.Printf("Failed to get ActivityPub key: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	publicKeyPem, err := activitypub.EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	base := projectURL()
+	actor := activitypub.Actor{
+		Context:           activitypub.Context,
+		ID:                activityPubActorURL(),
+		Type:              "Service",
+		PreferredUsername: settingConfig.ActivityPubUsername,
+		Name:              c["name"],
+		URL:               base + "/",
+		Inbox:             base + "/activitypub/inbox",
+		Outbox:            base + "/activitypub/outbox",
+		Followers:         base + "/activitypub/followers",
+		Discoverable:      true,
+		PublicKey: activitypub.PublicKey{
+			ID:           activityPubKeyId(),
+			Owner:        activityPubActorURL(),
+			PublicKeyPem: publicKeyPem,
+		},
+		Endpoints: &activitypub.Endpoints{SharedInbox: base + "/activitypub/inbox"},
+	}
+	if c["description"] != "" {
+		actor.Summary = "<p>" + html.EscapeString(c["description"]) + "</p>"
+	}
+	if c["logoUrl"] != "" {
+		actor.Icon = &activitypub.Image{Type: "Image", URL: absoluteURL(c["logoUrl"])}
+	}
+	if createdAt, err := time.Parse(time.RFC3339, c["created_at"]); err == nil {
+		actor.Published = &createdAt
+	}
+
+	writeActivityJSON(w, actor)
+}
+
+func absoluteURL(u string) string {
+	if strings.HasPrefix(u, "/") {
+		return projectURL() + u
+	}
+	return u
+}
+
+// messageNote converts a message as anonymous viewers see it.
+func messageNote(m *Message) *activitypub.Note {
+	renderer := markdown.Renderer{ResolveURL: absoluteURL}
+
+	note := &activitypub.Note{
+		ID:           activityPubNoteURL(m.ID),
+		Type:         "Note",
+		URL:          messageURL(projectURL(), m.ID),
+		AttributedTo: activityPubActorURL(),
+		Content:      renderer.ToHTML(m.Text),
+		Published:    m.Timestamp,
+		To:           []string{activitypub.Public},
+		Cc:           []string{projectURL() + "/activitypub/followers"},
+	}
+	if m.LastEdit.After(m.Timestamp) {
+		note.Updated = &m.LastEdit
+	}
+	if m.ReplyTo != 0 {
+		note.InReplyTo = activityPubNoteURL(m.ReplyTo)
+	}
+
+	for _, fileId := range messageFileIds(m) {
+		info, err := getFileInfo(fileId)
+		if err != nil || info == nil {
+			continue
+		}
+		note.Attachment = append(note.Attachment, activitypub.Attachment{
+			Type:      "Document",
+			MediaType: info.MimeType,
+			URL:       absoluteURL("/api/files/" + info.ID),
+			Name:      info.Filename,
+		})
+	}
+
+	return note
+}
+
+func noteActivity(activityType string, note *activitypub.Note, id string) activitypub.Activity {
+	return activitypub.Activity{
+		ID:        id,
+		Type:      activityType,
+		Actor:     activityPubActorURL(),
+		Published: &note.Published,
+		To:        note.To,
+		Cc:        note.Cc,
+		Object:    note,
+	}
+}
+
+func getActivityPubNote(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	m, err := dbGetMessage(ctx, id, false, false)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	note := messageNote(m)
+	note.Context = activitypub.Context
+	writeActivityJSON(w, note)
+}
+
+// getActivityPubOutbox lists the messages as Create activities, newest first.
+// Pages continue from the last message ID of the previous page.
+func getActivityPubOutbox(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	outboxURL := projectURL() + "/activitypub/outbox"
+
+	if r.URL.Query().Get("page") == "" {
+		total, err := rdb.ZCard(ctx, "m_times:1").Result()
+		if err != nil {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+
+		writeActivityJSON(w, activitypub.Collection{
+			Context:    activitypub.Context,
+			ID:         outboxURL,
+			Type:       "OrderedCollection",
+			TotalItems: &total,
+			First:      outboxURL + "?page=true",
+		})
+		return
+	}
+
+	mode := pageLatest
+	before, _ := strconv.Atoi(r.URL.Query().Get("before"))
+	if before > 0 {
+		mode = pageBefore
+	}
+	result, err := dbGetMessagePage(ctx, mode, before, time.Time{}, activityPubPageSize, false, false)
+	if err != nil {
+		if errors.Is(err, errCursorNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to get messages: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	messages := result.Messages
+
+	page := activitypub.Collection{
+		Context:      activitypub.Context,
+		ID:           outboxURL + "?" + r.URL.RawQuery,
+		Type:         "OrderedCollectionPage",
+		PartOf:       outboxURL,
+		OrderedItems: []any{},
+	}
+	for _, m := range messages {
+		if m.ID == 0 {
+			continue
+		}
+		note := messageNote(&m)
+		page.OrderedItems = append(page.OrderedItems, noteActivity("Create", note, note.ID+"#create"))
+	}
+	if result.HasMoreBefore && len(messages) > 0 {
+		page.Next = fmt.Sprintf("%s?page=true&before=%d", outboxURL, messages[len(messages)-1].ID)
+	}
+
+	writeActivityJSON(w, page)
+}
+
+// getActivityPubFollowers only tells how many followers there are, the list
+// itself is not published.
+func getActivityPubFollowers(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	total, err := dbCountActivityPubFollowers(ctx)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	writeActivityJSON(w, activitypub.Collection{
+		Context:    activitypub.Context,
+		ID:         projectURL() + "/activitypub/followers",
+		Type:       "OrderedCollection",
+		TotalItems: &total,
+	})
+}
+
+// postActivityPubInbox handles follows. The channel is read only, so any
+// other activity, like replies, is accepted and dropped.
+func postActivityPubInbox(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, activityPubMaxBodySize+1))
+	if err != nil {
+		http.Error(w, "error", http.StatusBadRequest)
+		return
+	}
+	if len(body) > activityPubMaxBodySize {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var activity activitypub.Activity
+	if err := json.Unmarshal(body, &activity); err != nil || activity.Actor == "" {
+		http.Error(w, "Invalid activity", http.StatusBadRequest)
+		return
+	}
+
+	actor, err := verifyActivityPubRequest(ctx, r, body, activity.Actor)
+	if err != nil {
+		// A deleted account can no longer be verified, and servers send
+		// its Delete to everyone it ever talked to.
+		if activity.Type == "Delete" && activity.ObjectID() == activity.Actor {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		log.Printf("Rejected ActivityPub %s from %s: %v\n", activity.Type, activity.Actor, err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if actor.ID != activity.Actor {
+		http.Error(w, "Actor does not match the signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		if activity.ObjectID() != activityPubActorURL() {
+			break
+		}
+		follower := Follower{Actor: actor.ID, Inbox: actor.Inbox, FollowedAt: time.Now()}
+		if actor.Endpoints != nil {
+			follower.SharedInbox = actor.Endpoints.SharedInbox
+		}
+		if follower.Inbox == "" {
+			http.Error(w, "Actor has no inbox", http.StatusBadRequest)
+			return
+		}
+		if err := dbAddActivityPubFollower(ctx, &follower); err != nil {
+			log.Printf("Failed to save follower: %v\n", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+
+		activity.Context = nil
+		accept := activitypub.Activity{
+			Context: activitypub.Context,
+			ID:      activityPubActorURL() + "#accepts/" + generatedRandomID(8),
+			Type:    "Accept",
+			Actor:   activityPubActorURL(),
+			Object:  activity,
+		}
+		if err := queueActivityPubDelivery(ctx, follower.Inbox, accept); err != nil {
+			log.Printf("Failed to queue follow accept: %v\n", err)
+		}
+		wakeActivityPubWorker()
+
+	case "Undo":
+		if inner := activity.ObjectActivity(); inner != nil && inner.Type == "Follow" && inner.Actor == actor.ID {
+			if err := dbRemoveActivityPubFollower(ctx, actor.ID); err != nil {
+				log.Printf("Failed to remove follower: %v\n", err)
+			}
+		}
+
+	case "Delete":
+		if activity.ObjectID() == actor.ID {
+			if err := dbRemoveActivityPubFollower(ctx, actor.ID); err != nil {
+				log.Printf("Failed to remove follower: %v\n", err)
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifyActivityPubRequest returns the actor that signed the request. The key
+// is fetched again once when it does not verify, in case it was rotated.
+// actorId is the actor the activity claims to be from.
+func verifyActivityPubRequest(ctx context.Context, r *http.Request, body []byte, actorId string) (*activitypub.Actor, error) {
+	keyId, err := activitypub.KeyID(r)
+	if err != nil {
+		return nil, err
+	}
+	// the key is fetched from keyId, which must be on the server of the
+	// actor that claims to send the activity
+	if !activitypub.SameHost(keyId, actorId) {
+		return nil, fmt.Errorf("key %s is not on the host of %s", keyId, actorId)
+	}
+
+	for _, refresh := range []bool{false, true} {
+		actor, err := fetchActivityPubActor(ctx, keyId, refresh)
+		if err != nil {
+			return nil, err
+		}
+		if actor.PublicKey.ID != keyId {
+			return nil, fmt.Errorf("key %s does not belong to %s", keyId, actor.ID)
+		}
+
+		key, err := activitypub.ParsePublicKey(actor.PublicKey.PublicKeyPem)
+		if err != nil {
+			return nil, err
+		}
+
+		err = activitypub.Verify(r, body, key, time.Now())
+		if err == nil {
+			return actor, nil
+		}
+		if !errors.Is(err, activitypub.ErrInvalidSignature) || refresh {
+			return nil, err
+		}
+	}
+
+	return nil, activitypub.ErrInvalidSignature
+}
+
+// fetchActivityPubActor loads a remote actor by its ID or the ID of its key,
+// which is the actor ID with a fragment. Actors are cached for a day, and
+// failed fetches for a few minutes, since anyone can make the inbox fetch an
+// actor by sending a signature.
+func fetchActivityPubActor(ctx context.Context, id string, refresh bool) (*activitypub.Actor, error) {
+	actorId, _, _ := strings.Cut(id, "#")
+
+	u, err := url.Parse(actorId)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid actor id %q", actorId)
+	}
+
+	if !refresh {
+		actor, err := dbGetCachedActivityPubActor(ctx, actorId)
+		if err != nil {
+			return nil, err
+		}
+		if actor != nil {
+			return actor, nil
+		}
+	}
+
+	failed, err := dbActivityPubActorFailed(ctx, actorId)
+	if err != nil {
+		return nil, err
+	}
+	if failed {
+		return nil, fmt.Errorf("fetching %s failed recently", actorId)
+	}
+
+	// Servers in authorized fetch mode only answer signed requests.
+	key, err := getActivityPubKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	actor, err := requestActivityPubActor(ctx, actorId, key)
+	if err != nil {
+		if err := dbSetActivityPubActorFailed(ctx, actorId, activityPubActorFailureTTL); err != nil {
+			log.Printf("Failed to cache actor failure %s: %v\n", actorId, err)
+		}
+		return nil, err
+	}
+
+	if err := dbCacheActivityPubActor(ctx, actor, activityPubActorTTL); err != nil {
+		log.Printf("Failed to cache actor %s: %v\n", actorId, err)
+	}
+
+	return actor, nil
+}
+
+func requestActivityPubActor(ctx context.Context, actorId string, key *rsa.PrivateKey) (*activitypub.Actor, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", actorId, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", activitypub.AcceptHeader)
+	req.Header.Set("User-Agent", activitypub.UserAgent)
+
+	if err := activitypub.Sign(req, nil, key, activityPubKeyId(), time.Now()); err != nil {
+		return nil, err
+	}
+
+	resp, err := activityPubClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: unexpected status code %d", actorId, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, activityPubMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	var actor activitypub.Actor
+	if err := json.Unmarshal(data, &actor); err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", actorId, err)
+	}
+	if actor.ID != actorId {
+		return nil, fmt.Errorf("fetching %s: got actor %s", actorId, actor.ID)
+	}
+
+	return &actor, nil
+}
+
+// federateMessage sends a message action to the followers. It is called from
+// SendWebhook, so the channel federates exactly what its webhooks report.
+func federateMessage(ctx context.Context, action string, messageId int) {
+	if !activityPubEnabled() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	followers, err := dbGetActivityPubFollowers(ctx)
+	if err != nil {
+		log.Printf("Failed to get followers: %v\n", err)
+		return
+	}
+	if len(followers) == 0 {
+		return
+	}
+
+	var activity activitypub.Activity
+	switch action {
+	case WebhookCreate, WebhookUpdate:
+		m, err := dbGetMessage(ctx, messageId, false, false)
+		if err != nil {
+			log.Printf("Failed to get message %d: %v\n", messageId, err)
+			return
+		}
+		if m == nil {
+			return
+		}
+		note := messageNote(m)
+		if action == WebhookCreate {
+			activity = noteActivity("Create", note, note.ID+"#create")
+		} else {
+			activity = noteActivity("Update", note, fmt.Sprintf("%s#updates/%d", note.ID, time.Now().UnixNano()))
+		}
+
+	case WebhookDelete:
+		noteId := activityPubNoteURL(messageId)
+		activity = activitypub.Activity{
+			ID:     noteId + "#delete",
+			Type:   "Delete",
+			Actor:  activityPubActorURL(),
+			To:     []string{activitypub.Public},
+			Object: activitypub.Tombstone{ID: noteId, Type: "Tombstone"},
+		}
+
+	default:
+		return
+	}
+	activity.Context = activitypub.Context
+
+	inboxes := make(map[string]bool)
+	for _, f := range followers {
+		inbox := f.DeliveryInbox()
+		if inboxes[inbox] {
+			continue
+		}
+		inboxes[inbox] = true
+
+		if err := queueActivityPubDelivery(ctx, inbox, activity); err != nil {
+			log.Printf("Failed to queue ActivityPub delivery to %s: %v\n", inbox, err)
+		}
+	}
+
+	wakeActivityPubWorker()
+}
+
+func queueActivityPubDelivery(ctx context.Context, inbox string, activity activitypub.Activity) error {
+	jsonActivity, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return dbCreateActivityPubDelivery(ctx, &ActivityPubDelivery{
+		Inbox:         inbox,
+		Activity:      string(jsonActivity),
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	})
+}
+
+func wakeActivityPubWorker() {
+	select {
+	case activityPubWake <- struct{}{}:
+	default:
+	}
+}
+
+func activityPubWorker() {
+	ticker := time.NewTicker(activityPubPollInterval)
+	defer ticker.Stop()
+
+	for {
+		processActivityPubQueue()
+
+		select {
+		case <-ticker.C:
+		case <-activityPubWake:
+		}
+	}
+}
+
+func processActivityPubQueue() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ids, err := dbClaimActivityPubDeliveries(ctx, time.Now(), activityPubLease, activityPubBatchSize)
+	cancel()
+	if err != nil {
+		log.Printf("Failed to claim ActivityPub deliveries: %v\n", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			d, err := dbGetActivityPubDelivery(ctx, id)
+			if err != nil {
+				log.Printf("Failed to load ActivityPub delivery %d: %v\n", id, err)
+				return
+			}
+			if d == nil {
+				rdb.ZRem(ctx, "activitypub:queue", id)
+				return
+			}
+
+			deliverActivityPub(ctx, d)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// deliverActivityPub makes one attempt and schedules the next one on failure.
+// A server that answers 410 Gone will never accept it, so it is not retried.
+func deliverActivityPub(ctx context.Context, d *ActivityPubDelivery) {
+	statusCode, err := postActivityPub(ctx, d)
+
+	d.Attempts++
+	switch {
+	case err == nil:
+		if err := dbDeleteActivityPubDelivery(ctx, d.ID); err != nil {
+			log.Printf("Failed to remove ActivityPub delivery %d: %v\n", d.ID, err)
+		}
+		return
+	case statusCode == http.StatusGone || d.Attempts >= activityPubMaxAttempts:
+		log.Printf("ActivityPub delivery %d to %s failed permanently: %v\n", d.ID, d.Inbox, err)
+		if err := dbDeleteActivityPubDelivery(ctx, d.ID); err != nil {
+			log.Printf("Failed to remove ActivityPub delivery %d: %v\n", d.ID, err)
+		}
+		return
+	}
+
+	d.Error = err.Error()
+	d.NextAttemptAt = time.Now().Add(activityPubBackoff(d.Attempts))
+	if err := dbUpdateActivityPubDelivery(ctx, d); err != nil {
+		log.Printf("Failed to save ActivityPub delivery %d: %v\n", d.ID, err)
+	}
+}
+
+func activityPubBackoff(attempts int) time.Duration {
+	backoff := activityPubRetryBase
+	for i := 1; i < attempts && backoff < activityPubRetryMax; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, activityPubRetryMax)
+}
+
+func postActivityPub(ctx context.Context, d *ActivityPubDelivery) (int, error) {
+	key, err := getActivityPubKey(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return activitypub.Deliver(ctx, activityPubClient, d.Inbox, []byte(d.Activity), key, activityPubKeyId())
+}
+
+func getActivityPubFollowersList(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	followers, err := dbGetActivityPubFollowers(ctx)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(followers)
+}
@@ -0,0 +1,215 @@
+// Package activitypub holds the ActivityStreams types and the HTTP Signatures
+// TheChannel needs to federate as a read-only actor that Mastodon and similar
+// servers can follow.
+//
+// Only the small subset used by a broadcast channel is covered: WebFinger,
+// the actor document, ordered collections, notes and the activities that
+// create, update and delete them, and following.
+package activitypub
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+const (
+	// ContentType is sent with every ActivityPub document and activity.
+	ContentType = "application/activity+json"
+	// AcceptHeader is what servers expect when fetching an actor.
+	AcceptHeader = `application/activity+json, application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
+
+	// Public is the special collection that addresses everyone.
+	Public = "https://www.w3.org/ns/activitystreams#Public"
+
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	securityContext        = "https://w3id.org/security/v1"
+)
+
+// Context is the JSON-LD context of top level documents.
+var Context = []string{activityStreamsContext, securityContext}
+
+var ErrInvalidKey = errors.New("activitypub: invalid key")
+
+type WebFinger struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []WebFingerLink `json:"links"`
+}
+
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+type Actor struct {
+	Context                   any        `json:"@context,omitempty"`
+	ID                        string     `json:"id"`
+	Type                      string     `json:"type"`
+	PreferredUsername         string     `json:"preferredUsername"`
+	Name                      string     `json:"name"`
+	Summary                   string     `json:"summary"`
+	URL                       string     `json:"url"`
+	Icon                      *Image     `json:"icon,omitempty"`
+	Inbox                     string     `json:"inbox"`
+	Outbox                    string     `json:"outbox"`
+	Followers                 string     `json:"followers"`
+	ManuallyApprovesFollowers bool       `json:"manuallyApprovesFollowers"`
+	Discoverable              bool       `json:"discoverable"`
+	Published                 *time.Time `json:"published,omitempty"`
+	PublicKey                 PublicKey  `json:"publicKey"`
+	Endpoints                 *Endpoints `json:"endpoints,omitempty"`
+}
+
+type Endpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type Image struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// Collection is an OrderedCollection or one of its pages.
+type Collection struct {
+	Context      any    `json:"@context,omitempty"`
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	TotalItems   *int64 `json:"totalItems,omitempty"`
+	First        string `json:"first,omitempty"`
+	PartOf       string `json:"partOf,omitempty"`
+	Next         string `json:"next,omitempty"`
+	OrderedItems []any  `json:"orderedItems,omitempty"`
+}
+
+type Note struct {
+	Context      any          `json:"@context,omitempty"`
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	URL          string       `json:"url"`
+	AttributedTo string       `json:"attributedTo"`
+	InReplyTo    string       `json:"inReplyTo,omitempty"`
+	Content      string       `json:"content"`
+	Published    time.Time    `json:"published"`
+	Updated      *time.Time   `json:"updated,omitempty"`
+	To           []string     `json:"to"`
+	Cc           []string     `json:"cc"`
+	Attachment   []Attachment `json:"attachment,omitempty"`
+}
+
+type Attachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType"`
+	URL       string `json:"url"`
+	Name      string `json:"name,omitempty"`
+}
+
+type Tombstone struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// Activity is sent and received as is. Object is either the ID of an object
+// or the object itself, which decodes as a map.
+type Activity struct {
+	Context   any        `json:"@context,omitempty"`
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	Actor     string     `json:"actor"`
+	Published *time.Time `json:"published,omitempty"`
+	To        []string   `json:"to,omitempty"`
+	Cc        []string   `json:"cc,omitempty"`
+	Object    any        `json:"object"`
+}
+
+// ObjectID returns the ID of the activity object.
+func (a *Activity) ObjectID() string {
+	switch object := a.Object.(type) {
+	case string:
+		return object
+	case map[string]any:
+		id, _ := object["id"].(string)
+		return id
+	}
+
+	return ""
+}
+
+// ObjectType returns the type of an embedded object, or "" when the object is
+// only referenced by its ID.
+func (a *Activity) ObjectType() string {
+	object, _ := a.Object.(map[string]any)
+	objectType, _ := object["type"].(string)
+	return objectType
+}
+
+// ObjectActivity returns the embedded object as an activity, as in the Follow
+// inside an Undo.
+func (a *Activity) ObjectActivity() *Activity {
+	object, ok := a.Object.(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	inner := &Activity{Object: object["object"]}
+	inner.ID, _ = object["id"].(string)
+	inner.Type, _ = object["type"].(string)
+	inner.Actor, _ = object["actor"].(string)
+
+	return inner
+}
+
+// GenerateKey creates the key the actor signs its requests with.
+func GenerateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+func EncodePrivateKey(key *rsa.PrivateKey) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func ParsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func EncodePublicKey(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// ParsePublicKey reads the publicKeyPem of an actor, which is PKIX almost
+// everywhere and PKCS #1 on some older servers.
+func ParsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, ErrInvalidKey
+	}
+
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
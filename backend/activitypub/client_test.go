@@ -0,0 +1,181 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSignVerify(t *testing.T) {
+	key := testKey(t)
+	body := []byte(`{"type":"Create"}`)
+	now := time.Now()
+
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("POST", "https://remote.example/inbox", bytes.NewReader(body))
+		if err := Sign(r, body, key, "https://channel.example/activitypub/actor#main-key", now); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := newRequest()
+	if keyId, err := KeyID(r); err != nil || keyId != "https://channel.example/activitypub/actor#main-key" {
+		t.Fatalf("KeyID = %q, %v", keyId, err)
+	}
+	if err := Verify(r, body, &key.PublicKey, now); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if err := Verify(newRequest(), []byte(`{"type":"Delete"}`), &key.PublicKey, now); !errors.Is(err, ErrInvalidDigest) {
+		t.Errorf("changed body: got %v, want %v", err, ErrInvalidDigest)
+	}
+
+	if err := Verify(newRequest(), body, &testKey(t).PublicKey, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("other key: got %v, want %v", err, ErrInvalidSignature)
+	}
+
+	if err := Verify(newRequest(), body, &key.PublicKey, now.Add(2*SignatureTolerance)); !errors.Is(err, ErrExpiredSignature) {
+		t.Errorf("old date: got %v, want %v", err, ErrExpiredSignature)
+	}
+
+	moved := newRequest()
+	moved.URL.Path = "/other-inbox"
+	if err := Verify(moved, body, &key.PublicKey, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("other target: got %v, want %v", err, ErrInvalidSignature)
+	}
+
+	unsigned := httptest.NewRequest("POST", "https://remote.example/inbox", bytes.NewReader(body))
+	if err := Verify(unsigned, body, &key.PublicKey, now); !errors.Is(err, ErrMissingSignature) {
+		t.Errorf("unsigned: got %v, want %v", err, ErrMissingSignature)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	key := testKey(t)
+	activity := []byte(`{"type":"Create","actor":"https://channel.example/activitypub/actor"}`)
+
+	var received []byte
+	inbox := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != ContentType {
+			http.Error(w, "content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := Verify(r, body, &key.PublicKey, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		received = body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer inbox.Close()
+
+	status, err := Deliver(context.Background(), inbox.Client(), inbox.URL+"/inbox", activity, key, "https://channel.example/activitypub/actor#main-key")
+	if err != nil || status != http.StatusAccepted {
+		t.Fatalf("Deliver = %d, %v", status, err)
+	}
+	if !bytes.Equal(received, activity) {
+		t.Errorf("inbox received %s, want %s", received, activity)
+	}
+
+	status, err = Deliver(context.Background(), inbox.Client(), inbox.URL+"/inbox", activity, testKey(t), "https://channel.example/activitypub/actor#main-key")
+	if err == nil || status != http.StatusUnauthorized {
+		t.Errorf("Deliver with another key = %d, %v, want %d and an error", status, err, http.StatusUnauthorized)
+	}
+}
+
+func TestNewClientRefusesNonPublicAddresses(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	_, err := Deliver(context.Background(), NewClient(time.Second), server.URL+"/inbox", []byte(`{}`), testKey(t), "https://channel.example/activitypub/actor#main-key")
+	if !errors.Is(err, ErrNonPublicAddress) {
+		t.Errorf("got %v, want %v", err, ErrNonPublicAddress)
+	}
+	if called {
+		t.Error("the loopback server was reached")
+	}
+}
+
+func TestNewClientRefusesRedirects(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the redirect was followed")
+	}))
+	defer target.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer redirect.Close()
+
+	// the address check would refuse the loopback server before the redirect
+	client := NewClient(time.Second)
+	client.Transport = http.DefaultTransport
+
+	_, err := client.Get(redirect.URL)
+	if !errors.Is(err, ErrRedirect) {
+		t.Errorf("got %v, want %v", err, ErrRedirect)
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.215.14":        true,
+		"2606:4700::1111":      true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"::1":                  false,
+		"fe80::1":              false,
+		"fd00::1":              false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:93.184.215.14": true,
+		"64:ff9b::a00:1":       false,
+		"ff02::1":              false,
+		"224.0.0.1":            false,
+		"255.255.255.255":      false,
+	} {
+		if got := IsPublicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("IsPublicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestSameHost(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"https://mastodon.example/users/a#main-key", "https://mastodon.example/users/a", true},
+		{"https://Mastodon.example/users/a#main-key", "https://mastodon.example/users/b", true},
+		{"http://169.254.169.254/latest#key", "https://mastodon.example/users/a", false},
+		{"https://mastodon.example:8443/users/a#key", "https://mastodon.example/users/a", false},
+		{"not a url", "https://mastodon.example/users/a", false},
+	}
+	for _, tt := range tests {
+		if got := SameHost(tt.a, tt.b); got != tt.want {
+			t.Errorf("SameHost(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Requests are signed with HTTP Signatures (draft-cavage-http-signatures-12)
+// using rsa-sha256, as Mastodon expects. POST bodies are covered through the
+// Digest header.
+
+// SignatureTolerance is how far the Date of a signed request may be from now.
+const SignatureTolerance = time.Hour
+
+var (
+	ErrMissingSignature = errors.New("activitypub: missing signature")
+	ErrInvalidSignature = errors.New("activitypub: invalid signature")
+	ErrExpiredSignature = errors.New("activitypub: date outside of the allowed window")
+	ErrInvalidDigest    = errors.New("activitypub: digest does not match the body")
+)
+
+// Sign adds the Date, Digest and Signature headers to the request. body is
+// the request body, nil for a GET.
+func Sign(r *http.Request, body []byte, key *rsa.PrivateKey, keyId string, now time.Time) error {
+	r.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		r.Header.Set("Digest", digest(body))
+		headers = append(headers, "digest")
+	}
+
+	hash := sha256.Sum256([]byte(signingString(r, headers)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyId, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+
+	return nil
+}
+
+// KeyID returns the keyId of the request signature, which names the key to
+// verify it with.
+func KeyID(r *http.Request) (string, error) {
+	params, err := signatureParams(r)
+	if err != nil {
+		return "", err
+	}
+
+	return params["keyId"], nil
+}
+
+// Verify checks the request signature against the key. The request target
+// and Date must be signed, and the Digest too when there is a body.
+func Verify(r *http.Request, body []byte, key *rsa.PublicKey, now time.Time) error {
+	params, err := signatureParams(r)
+	if err != nil {
+		return err
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+
+	if !slices.Contains(headers, "(request-target)") {
+		return ErrInvalidSignature
+	}
+	if len(body) > 0 {
+		if !slices.Contains(headers, "digest") {
+			return ErrInvalidSignature
+		}
+		if !digestMatches(r.Header.Get("Digest"), body) {
+			return ErrInvalidDigest
+		}
+	}
+
+	if !slices.Contains(headers, "date") {
+		return ErrInvalidSignature
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if date.Before(now.Add(-SignatureTolerance)) || date.After(now.Add(SignatureTolerance)) {
+		return ErrExpiredSignature
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	hash := sha256.Sum256([]byte(signingString(r, headers)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, name := range headers {
+		var value string
+		switch name {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			value = r.Host
+			if value == "" {
+				value = r.URL.Host
+			}
+		default:
+			value = strings.Join(r.Header.Values(name), ", ")
+		}
+		lines[i] = name + ": " + value
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// signatureParams parses `keyId="...",algorithm="...",headers="...",signature="..."`.
+func signatureParams(r *http.Request) (map[string]string, error) {
+	header := r.Header.Get("Signature")
+	if header == "" {
+		return nil, ErrMissingSignature
+	}
+
+	params := make(map[string]string)
+	for header != "" {
+		name, rest, ok := strings.Cut(header, "=")
+		if !ok || !strings.HasPrefix(rest, `"`) {
+			return nil, ErrInvalidSignature
+		}
+		value, rest, ok := strings.Cut(rest[1:], `"`)
+		if !ok {
+			return nil, ErrInvalidSignature
+		}
+		params[strings.TrimSpace(name)] = value
+		header = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+
+	if params["keyId"] == "" || params["signature"] == "" {
+		return nil, ErrInvalidSignature
+	}
+
+	return params, nil
+}
+
+func digest(body []byte) string {
+	hash := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func digestMatches(header string, body []byte) bool {
+	expected := digest(body)
+	for _, value := range strings.Split(header, ",") {
+		if strings.TrimSpace(value) == expected {
+			return true
+		}
+	}
+
+	return false
+}
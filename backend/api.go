@@ -3,46 +3,414 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/go-chi/chi"
 )
 
-func addNewPost(w http.ResponseWriter, r *http.Request) {
-	key := r.Header.Get("X-API-Key")
-	if key != settingConfig.ApiSecretKey {
-		http.Error(w, "error", http.StatusBadRequest)
-		return
+var messageTypes = []string{"md", "text", "image", "video", "audio", "document", "other"}
+
+const (
+	// importPendingTTL bounds how long a key stays claimed by a request that
+	// died before creating its message.
+	importPendingTTL     = time.Minute
+	importIdempotencyTTL = 24 * time.Hour
+)
+
+var errImportInProgress = errors.New("import with the same key is in progress")
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+// apiError is used by the API key routes, whose clients are programs that
+// expect a JSON body on every response.
+func apiError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ApiError{Error: message})
+}
+
+// ApiMessageUpdate holds the fields an integration may change. Fields left
+// out of the request keep their current value.
+type ApiMessageUpdate struct {
+	ID    int           `json:"id"`
+	Type  *string       `json:"type"`
+	Text  *string       `json:"text"`
+	File  *FileResponse `json:"file"`
+	IsAds *bool         `json:"is_ads"`
+}
+
+// fileEmbed returns the markdown the web client inserts for an uploaded file.
+func fileEmbed(f FileResponse) string {
+	switch f.FileType {
+	case "image", "video", "audio":
+		return fmt.Sprintf("[%s-embedded#](%s)", f.FileType, f.URL)
+	default:
+		return fmt.Sprintf("[%s](%s)", f.Filename, f.URL)
+	}
+}
+
+// withFileEmbed appends the file to the text unless the text already links to
+// it, since messages are rendered from their text only.
+func withFileEmbed(text string, f FileResponse) string {
+	if f.URL == "" || strings.Contains(text, f.URL) {
+		return text
 	}
 
-	var message Message
-	var err error
+	if text == "" {
+		return fileEmbed(f)
+	}
+
+	return text + "\n" + fileEmbed(f)
+}
+
+func addNewPost(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	body := Message{}
-	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		log.Printf("Failed to decode message: %v\n", err)
-		http.Error(w, "error", http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if body.Type == "" {
+		body.Type = "md"
+	}
+	if !slices.Contains(messageTypes, body.Type) {
+		apiError(w, http.StatusBadRequest, "Invalid message type")
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	if ok, err := replyTargetExists(ctx, body.ReplyTo); err != nil || !ok {
+		apiError(w, http.StatusBadRequest, "Reply target not found")
+		return
+	}
+
+	idempotencyKey := ""
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		idempotencyKey = importIdempotencyKey(requestApiKeyId(r), key)
+	}
+
+	message, replayed, err := importMessage(ctx, body, idempotencyKey, false)
+	if err != nil {
+		if errors.Is(err, errImportInProgress) {
+			apiError(w, http.StatusConflict, "A request with the same key is in progress")
+			return
+		}
+		log.Printf("Failed to set new message: %v\n", err)
+		apiError(w, http.StatusInternalServerError, "Failed to save message")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	json.NewEncoder(w).Encode(message)
+}
+
+// importMessage creates the message once per external ID or idempotency key,
+// which is the store key from importIdempotencyKey. When the key was seen
+// before it returns the message created then, and replayed is true.
+// Backfilled messages keep their views, reactions and author ID, and are
+// stored without a live event.
+func importMessage(ctx context.Context, body Message, idempotencyKey string, backfill bool) (*Message, bool, error) {
+	var keys []string
+	var ttls []time.Duration
+	if body.ExternalId != "" {
+		keys = append(keys, externalIdKey(body.ExternalId))
+		ttls = append(ttls, 0)
+	}
+	if idempotencyKey != "" {
+		keys = append(keys, idempotencyKey)
+		ttls = append(ttls, importIdempotencyTTL)
+	}
+
+	for i, key := range keys {
+		reserved, id, err := dbReserveImportKey(ctx, key)
+		if err != nil {
+			releaseImportKeys(keys[:i])
+			return nil, false, err
+		}
+		if reserved {
+			continue
+		}
+
+		releaseImportKeys(keys[:i])
+		if id == 0 {
+			return nil, false, errImportInProgress
+		}
+
+		m, err := dbGetMessage(ctx, id, true, settingConfig.CountViews)
+		if err != nil {
+			return nil, false, err
+		}
+		if m == nil {
+			return nil, false, fmt.Errorf("imported message %d not found", id)
+		}
+		return m, true, nil
+	}
+
+	var message Message
 	message.ID = getMessageNextId(ctx)
-	message.Type = "md" //body.Type
+	message.Type = body.Type
 	message.Author = body.Author
 	message.Timestamp = body.Timestamp
-	message.Text = body.Text
+	message.Text = withFileEmbed(body.Text, body.File)
+	message.File = body.File
 	message.Views = 0
 	message.IsAds = body.IsAds
+	message.ExternalId = body.ExternalId
+	message.ReplyTo = body.ReplyTo
 
-	if err = setMessage(ctx, &message, false); err != nil {
-		log.Printf("Failed to set new message: %v\n", err)
-		http.Error(w, "error", http.StatusInternalServerError)
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+
+	save := setMessage
+	if backfill {
+		message.AuthorId = body.AuthorId
+		message.LastEdit = body.LastEdit
+		message.Views = body.Views
+		if len(body.Reactions) > 0 {
+			// an empty map is stored as "{}", which the Lua scripts return as "[]"
+			message.Reactions = body.Reactions
+		}
+		save = storeMessage
+	}
+
+	if err := save(ctx, &message, false); err != nil {
+		releaseImportKeys(keys)
+		return nil, false, err
+	}
+
+	if backfill {
+		if err := dbSetImportedReactions(ctx, message.ID, body.Reactions); err != nil {
+			log.Printf("Failed to save reactions for message %d: %v\n", message.ID, err)
+		}
+	}
+
+	for i, key := range keys {
+		if err := dbSetImportKey(ctx, key, message.ID, ttls[i]); err != nil {
+			log.Printf("Failed to save import key for message %d: %v\n", message.ID, err)
+		}
+	}
+
+	return &message, false, nil
+}
+
+func releaseImportKeys(keys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, key := range keys {
+		dbReleaseImportKey(ctx, key)
+	}
+}
+
+func externalIdKey(externalId string) string {
+	return "import:external:" + externalId
+}
+
+// importIdempotencyKey scopes the client's key to the API key that sent it,
+// so two integrations picking the same key do not get each other's message.
+func importIdempotencyKey(apiKeyId, key string) string {
+	return "import:idempotency:" + apiKeyId + ":" + key
+}
+
+// getMessageIdByExternalId lets a bridge find the message it imported, to
+// edit or delete it later.
+func getMessageIdByExternalId(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	externalId := chi.URLParam(r, "externalId")
+
+	id, err := dbGetMessageIdByExternalId(ctx, externalId)
+	if err != nil {
+		log.Printf("Failed to get message by external id: %v\n", err)
+		apiError(w, http.StatusInternalServerError, "Failed to get message")
+		return
+	}
+
+	if id == 0 {
+		apiError(w, http.StatusNotFound, "Message not found")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "externalId": externalId})
+}
+
+func getApiMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "Invalid message id")
+		return
+	}
+
+	message, err := dbGetMessage(ctx, id, true, settingConfig.CountViews)
+	if err != nil {
+		log.Printf("Failed to get message: %v\n", err)
+		apiError(w, http.StatusInternalServerError, "Failed to get message")
+		return
+	}
+
+	if message == nil {
+		apiError(w, http.StatusNotFound, "Message not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
+
+func updateApiMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	var body ApiMessageUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apiError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if body.Type != nil && !slices.Contains(messageTypes, *body.Type) {
+		apiError(w, http.StatusBadRequest, "Invalid message type")
+		return
+	}
+
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "Invalid If-Match header")
+		return
+	}
+
+	message, err := dbGetMessage(ctx, body.ID, true, settingConfig.CountViews)
+	if err != nil {
+		log.Printf("Failed to get message: %v\n", err)
+		apiError(w, http.StatusInternalServerError, "Failed to get message")
+		return
+	}
+
+	if message == nil {
+		apiError(w, http.StatusNotFound, "Message not found")
+		return
+	}
+
+	before := *message
+	if body.Type != nil {
+		message.Type = *body.Type
+	}
+	if body.Text != nil {
+		message.Text = *body.Text
+	}
+	if body.File != nil {
+		message.File = *body.File
+	}
+	if body.IsAds != nil {
+		message.IsAds = *body.IsAds
+	}
+	if body.Text != nil || body.File != nil {
+		message.Text = withFileEmbed(message.Text, message.File)
+	}
+	message.LastEdit = time.Now()
+
+	editorId, editor := apiEditor(r)
+	setMessageEditor(&before, message, editorId, editor)
+
+	if err := editMessage(ctx, &before, message, ifVersion); err != nil {
+		switch {
+		case errors.Is(err, errMessageVersionConflict):
+			apiError(w, http.StatusPreconditionFailed, "Message was changed by another edit")
+		case errors.Is(err, errMessageNotFound):
+			apiError(w, http.StatusNotFound, "Message not found")
+		default:
+			log.Printf("Failed to update message: %v\n", err)
+			apiError(w, http.StatusInternalServerError, "Failed to save message")
+		}
+		return
+	}
+
+	go SendWebhook(context.Background(), WebhookUpdate, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", messageETag(message))
 	json.NewEncoder(w).Encode(message)
 }
+
+func deleteApiMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "Invalid message id")
+		return
+	}
+
+	existing, err := dbGetMessage(ctx, id, true, false)
+	if err != nil {
+		log.Printf("Failed to get message: %v\n", err)
+		apiError(w, http.StatusInternalServerError, "Failed to get message")
+		return
+	}
+
+	if existing == nil {
+		apiError(w, http.StatusNotFound, "Message not found")
+		return
+	}
+
+	if err := funcDeleteMessage(ctx, strconv.Itoa(id)); err != nil {
+		apiError(w, http.StatusInternalServerError, "Failed to delete message")
+		return
+	}
+
+	message := Message{ID: id, Deleted: true}
+	go SendWebhook(context.Background(), WebhookDelete, &message)
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func uploadApiFile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(settingConfig.MaxFileSize)<<20)
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		if errors.As(err, &maxBytesReader) {
+			apiError(w, http.StatusRequestEntityTooLarge, "File too large")
+			return
+		}
+		apiError(w, http.StatusBadRequest, "Missing file")
+		return
+	}
+	defer file.Close()
+
+	fileResponse, err := saveFile(file, handler.Filename)
+	if err != nil {
+		log.Printf("Failed to save file: %v\n", err)
+		apiError(w, http.StatusInternalServerError, "Failed to save file")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileResponse)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+type ApiScope string
+
+const (
+	ScopePost   ApiScope = "post"   // create messages
+	ScopeEdit   ApiScope = "edit"   // edit messages
+	ScopeDelete ApiScope = "delete" // delete messages
+	ScopeUpload ApiScope = "upload" // upload files
+	ScopeRead   ApiScope = "read"   // read messages
+)
+
+var apiScopes = []ApiScope{ScopePost, ScopeEdit, ScopeDelete, ScopeUpload, ScopeRead}
+
+// apiKeyPrefix marks channel API keys so they are easy to recognize in logs
+// and secret scanners.
+const apiKeyPrefix = "chk_"
+
+// ApiKey is stored without the key itself, only its SHA-256 hash. The key is
+// shown once, when it is created.
+type ApiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash,omitempty"`
+	Hint       string     `json:"hint"` // last characters of the key
+	Scopes     []ApiScope `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	CreatedBy  string     `json:"createdBy"`
+	ExpiresAt  time.Time  `json:"expiresAt"` // zero means no expiry
+	LastUsedAt time.Time  `json:"lastUsedAt"`
+	RevokedAt  time.Time  `json:"revokedAt"`
+}
+
+func (k *ApiKey) HasScope(scope ApiScope) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+func (k *ApiKey) IsActive(now time.Time) bool {
+	return k.RevokedAt.IsZero() && (k.ExpiresAt.IsZero() || now.Before(k.ExpiresAt))
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type apiKeyContextKey struct{}
+
+// requestApiKey returns the key the request was made with, or nil for the
+// legacy api_secret_key.
+func requestApiKey(r *http.Request) *ApiKey {
+	apiKey, _ := r.Context().Value(apiKeyContextKey{}).(*ApiKey)
+	return apiKey
+}
+
+// requestApiKeyId returns the ID of the key the request was made with, or
+// "legacy" for the api_secret_key.
+func requestApiKeyId(r *http.Request) string {
+	if apiKey := requestApiKey(r); apiKey != nil {
+		return apiKey.ID
+	}
+	return "legacy"
+}
+
+// apiEditor names the API key as the editor of a message.
+func apiEditor(r *http.Request) (string, string) {
+	if apiKey := requestApiKey(r); apiKey != nil {
+		return "api-key:" + apiKey.ID, apiKey.Name
+	}
+	return "api", "API"
+}
+
+// protectedWithApiKey checks the X-API-Key header against the stored keys and
+// the scope the route needs. The legacy api_secret_key setting is still
+// accepted for posting, but never when it is empty.
+func protectedWithApiKey(scope ApiScope, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			apiError(w, http.StatusUnauthorized, "Missing API key")
+			return
+		}
+
+		if scope == ScopePost && settingConfig.ApiSecretKey != "" &&
+			subtle.ConstantTimeCompare([]byte(key), []byte(settingConfig.ApiSecretKey)) == 1 {
+			handler(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		apiKey, err := dbGetApiKeyByHash(ctx, hashApiKey(key))
+		if err != nil {
+			log.Printf("Failed to get API key: %v\n", err)
+			apiError(w, http.StatusInternalServerError, "error")
+			return
+		}
+
+		if apiKey == nil || !apiKey.IsActive(time.Now()) {
+			apiError(w, http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+
+		if !apiKey.HasScope(scope) {
+			apiError(w, http.StatusForbidden, "API key not allowed for this action")
+			return
+		}
+
+		go dbTouchApiKey(apiKey.ID, time.Now())
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, apiKey)))
+	}
+}
+
+func getApiKeysList(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	keys, err := dbGetApiKeys(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get API keys list", http.StatusInternalServerError)
+		return
+	}
+
+	for _, k := range keys {
+		k.Hash = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+type CreateApiKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []ApiScope `json:"scopes"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+}
+
+type CreateApiKeyResponse struct {
+	ApiKey
+	Key string `json:"key"`
+}
+
+// createApiKey generates a new key. The response is the only place the key
+// appears in plain text.
+func createApiKey(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	var req CreateApiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" || len(req.Scopes) == 0 {
+		http.Error(w, "Name and scopes are required", http.StatusBadRequest)
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiScopes, scope) {
+			http.Error(w, "Invalid scope: "+string(scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !req.ExpiresAt.IsZero() && req.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Expiry is in the past", http.StatusBadRequest)
+		return
+	}
+
+	key := apiKeyPrefix + generatedRandomID(32)
+	if key == apiKeyPrefix {
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := store.Get(r, cookieName)
+	user, _ := session.Values["user"].(Session)
+
+	apiKey := ApiKey{
+		ID:        generatedRandomID(8),
+		Name:      req.Name,
+		Hash:      hashApiKey(key),
+		Hint:      key[len(key)-4:],
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		CreatedAt: time.Now(),
+		CreatedBy: user.Email,
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	if err := dbCreateApiKey(ctx, &apiKey); err != nil {
+		log.Printf("Failed to create API key: %v\n", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	apiKey.Hash = ""
+	response := CreateApiKeyResponse{ApiKey: apiKey, Key: key}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func revokeApiKey(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id := chi.URLParam(r, "id")
+
+	found, err := dbRevokeApiKey(ctx, id, time.Now())
+	if err != nil {
+		log.Printf("Failed to revoke API key: %v\n", err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
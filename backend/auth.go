@@ -135,6 +135,11 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	go sendWebhookEvent(context.Background(), WebhookPayload{
+		Action: WebhookLogin,
+		Login:  webhookUserFromSession(userSession),
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 
 	response := Response{Success: true}
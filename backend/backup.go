@@ -0,0 +1,400 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/icza/dyno"
+	"gopkg.in/yaml.v3"
+
+	"channel/telegram"
+)
+
+const backupVersion = 1
+
+const (
+	backupManifestFile = "manifest.json"
+	backupDataFile     = "data.ndjson"
+	backupFilesDir     = "files/"
+)
+
+// backupKeys are the single keys of a channel. Keys that are derived from
+// others, like the search index, are rebuilt on restore instead.
+var backupKeys = []string{
+	"channel:1",
+	"settings:list",
+	"users:list",
+	"emojis:list",
+	"scheduled_messages:list",
+	"m_times:1",
+	"pinned_messages",
+	"pinned_messages:expires",
+	"deleted_messages",
+	"message:next_id",
+	"reports:list",
+	"reports:open",
+	"reports:closed",
+	"report:next_id",
+}
+
+// backupPatterns match the per-message and per-report keys.
+var backupPatterns = []string{
+	"messages:*",
+	"message:*:reactions",
+	"message:*:imported_reactions",
+	"message:*:replies",
+	"message:*:revisions",
+	"report:*",
+	"import:external:*",
+}
+
+var fileUrlPattern = regexp.MustCompile(`/api/files/([0-9a-f]{40})`)
+
+type BackupManifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Keys      int       `json:"keys"`
+	Files     int       `json:"files"`
+}
+
+// exportChannel streams a zip archive with every channel key and the uploaded
+// files the channel refers to, which restoreChannel can load into an empty
+// instance.
+func exportChannel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	filename := fmt.Sprintf("channel-backup-%s.zip", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if err := writeBackup(ctx, w); err != nil {
+		log.Printf("Failed to export channel: %v\n", err)
+	}
+}
+
+func writeBackup(ctx context.Context, out io.Writer) error {
+	archive := zip.NewWriter(out)
+	manifest := BackupManifest{Version: backupVersion, CreatedAt: time.Now()}
+
+	keys, err := backupKeyList(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := archive.Create(backupDataFile)
+	if err != nil {
+		return err
+	}
+
+	fileIds := make(map[string]bool)
+	encoder := json.NewEncoder(data)
+	for _, key := range keys {
+		dump, err := dbDumpKey(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to dump %s: %v", key, err)
+		}
+		if dump == nil {
+			continue
+		}
+
+		if err := encoder.Encode(dump); err != nil {
+			return err
+		}
+		manifest.Keys++
+
+		for _, id := range referencedFiles(dump) {
+			fileIds[id] = true
+		}
+	}
+
+	blobs := make(map[string]bool)
+	for id := range fileIds {
+		ok, err := writeBackupFile(archive, id, blobs)
+		if err != nil {
+			return fmt.Errorf("failed to add file %s: %v", id, err)
+		}
+		if ok {
+			manifest.Files++
+		}
+	}
+
+	manifestFile, err := archive.Create(backupManifestFile)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(manifestFile).Encode(manifest); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func backupKeyList(ctx context.Context) ([]string, error) {
+	keys := slices.Clone(backupKeys)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		seen[key] = true
+	}
+
+	for _, pattern := range backupPatterns {
+		matched, err := dbScanKeys(ctx, pattern)
+		if err != nil {
+			return nil, err
+		}
+		slices.Sort(matched)
+		for _, key := range matched {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// referencedFiles returns the IDs of uploaded files linked from the key.
+func referencedFiles(dump *KeyDump) []string {
+	var text strings.Builder
+	switch {
+	case dump.Hash != nil:
+		for _, value := range dump.Hash {
+			text.WriteString(value)
+			text.WriteString("\n")
+		}
+	case dump.Type == "list":
+		// message revisions keep the files of earlier versions
+		members, _ := dump.Value.([]string)
+		for _, member := range members {
+			text.WriteString(member)
+			text.WriteString("\n")
+		}
+	default:
+		value, _ := dyno.GetString(dump.Value)
+		text.WriteString(value)
+	}
+
+	ids := []string{}
+	for _, match := range fileUrlPattern.FindAllStringSubmatch(text.String(), -1) {
+		ids = append(ids, match[1])
+	}
+
+	return ids
+}
+
+// writeBackupFile adds the YAML metadata of the file and the content it points
+// to, at the same paths they have under rootUploadPath. ok is false when the
+// file no longer exists.
+func writeBackupFile(archive *zip.Writer, id string, blobs map[string]bool) (bool, error) {
+	metadataPath := filepath.Join(id[:2], id[2:4], id+".yaml")
+	metadata, err := os.ReadFile(filepath.Join(rootUploadPath, metadataPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	var metaData map[string]any
+	if err := yaml.Unmarshal(metadata, &metaData); err != nil {
+		return false, err
+	}
+
+	fileHash, _ := dyno.GetString(metaData["hash"])
+	if len(fileHash) < 4 {
+		return false, fmt.Errorf("invalid hash in %s", metadataPath)
+	}
+	blobPath := filepath.Join(fileHash[:2], fileHash[2:4], fileHash)
+
+	metadataFile, err := archive.Create(backupFilesDir + filepath.ToSlash(metadataPath))
+	if err != nil {
+		return false, err
+	}
+	if _, err := metadataFile.Write(metadata); err != nil {
+		return false, err
+	}
+
+	// Several metadata files can point to one blob, it is stored once.
+	if blobs[fileHash] {
+		return true, nil
+	}
+	blobs[fileHash] = true
+
+	blob, err := os.Open(filepath.Join(rootUploadPath, blobPath))
+	if err != nil {
+		return false, err
+	}
+	defer blob.Close()
+
+	// Uploads are mostly media that does not compress.
+	blobFile, err := archive.CreateHeader(&zip.FileHeader{Name: backupFilesDir + filepath.ToSlash(blobPath), Method: zip.Store})
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(blobFile, blob)
+
+	return true, err
+}
+
+type RestoreSummary struct {
+	Keys     int `json:"keys"`
+	Files    int `json:"files"`
+	Messages int `json:"messages"`
+}
+
+// restoreChannel loads a backup archive into an instance with no messages.
+// With dryRun it only reads and validates the archive.
+func restoreChannel(path string, dryRun bool) (*RestoreSummary, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	var manifest BackupManifest
+	if err := readBackupJSON(&archive.Reader, backupManifestFile, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	messages, err := rdb.ZCard(ctx, "m_times:1").Result()
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if messages > 0 {
+		return nil, fmt.Errorf("the channel already has %d messages, restore needs an empty instance", messages)
+	}
+
+	// Validate the whole archive before writing, so a broken archive does
+	// not leave a half restored channel.
+	if !dryRun {
+		if _, err := restoreChannel(path, true); err != nil {
+			return nil, err
+		}
+	}
+
+	summary := &RestoreSummary{}
+
+	data, err := archive.Open(backupDataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	scanner := bufio.NewScanner(data)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var dump KeyDump
+		if err := json.Unmarshal(scanner.Bytes(), &dump); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", backupDataFile, line, err)
+		}
+		if dump.Key == "" {
+			return nil, fmt.Errorf("%s line %d: missing key", backupDataFile, line)
+		}
+
+		summary.Keys++
+		if strings.HasPrefix(dump.Key, "messages:") {
+			summary.Messages++
+		}
+
+		if dryRun {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := dbRestoreKey(ctx, &dump)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %v", dump.Key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, f := range archive.File {
+		name, ok := strings.CutPrefix(f.Name, backupFilesDir)
+		if !ok || f.FileInfo().IsDir() {
+			continue
+		}
+		if !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("invalid path in archive: %s", f.Name)
+		}
+
+		summary.Files++
+		if dryRun {
+			continue
+		}
+
+		dest := filepath.Join(rootUploadPath, name)
+		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			return nil, err
+		}
+		if _, err := telegram.ExtractZipFile(f, dest, int64(f.UncompressedSize64)); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %v", f.Name, err)
+		}
+	}
+
+	if !dryRun {
+		// The search index is not part of the archive, it is built again.
+		// Archives from before the trash get their deleted messages indexed.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		rdb.Del(ctx, "search:version")
+		rdb.Del(ctx, "deleted_messages:indexed")
+		cancel()
+		reindexSearch()
+		indexDeletedMessages()
+	}
+
+	return summary, nil
+}
+
+func readBackupJSON(archive *zip.Reader, name string, v any) error {
+	f, err := archive.Open(name)
+	if err != nil {
+		return fmt.Errorf("invalid backup archive: %v", err)
+	}
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(v)
+}
+
+// runRestoreCommand implements "the-channel restore [-dry-run] <archive>".
+func runRestoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "validate the archive without writing anything")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal("usage: the-channel restore [-dry-run] <archive.zip>")
+	}
+
+	summary, err := restoreChannel(flags.Arg(0), *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	action := "Restored"
+	if *dryRun {
+		action = "Dry run: would restore"
+	}
+	log.Printf("%s %d keys (%d messages) and %d files\n", action, summary.Keys, summary.Messages, summary.Files)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	bulkImportMaxItems    = 5000
+	bulkImportMaxBodySize = 64 << 20
+)
+
+type BulkImportStatus string
+
+const (
+	BulkImportCreated  BulkImportStatus = "created"
+	BulkImportExisting BulkImportStatus = "existing" // external ID was imported before
+	BulkImportFailed   BulkImportStatus = "failed"
+)
+
+// BulkImportResult reports the outcome of one item, by its position in the
+// request.
+type BulkImportResult struct {
+	Index      int              `json:"index"`
+	Status     BulkImportStatus `json:"status"`
+	ID         int              `json:"id,omitempty"`
+	ExternalId string           `json:"externalId,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+type BulkImportResponse struct {
+	Created  int                `json:"created"`
+	Existing int                `json:"existing"`
+	Failed   int                `json:"failed"`
+	Results  []BulkImportResult `json:"results"`
+}
+
+// bulkImport backfills a channel history. The body is a JSON array of
+// messages or one message per line (NDJSON). Messages are stored in timestamp
+// order so IDs follow the original order, and no notifications, webhooks or
+// live events are sent for them.
+func bulkImport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, bulkImportMaxBodySize)
+	defer r.Body.Close()
+
+	items, err := readBulkImportItems(r.Body)
+	if err != nil {
+		if errors.As(err, &maxBytesReader) {
+			apiError(w, http.StatusRequestEntityTooLarge, "Request too large")
+			return
+		}
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(items) > bulkImportMaxItems {
+		apiError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Too many messages, the limit is %d", bulkImportMaxItems))
+		return
+	}
+
+	response := BulkImportResponse{Results: make([]BulkImportResult, len(items))}
+	messages := make([]Message, len(items))
+	order := []int{}
+
+	for i, item := range items {
+		response.Results[i].Index = i
+		if err := json.Unmarshal(item, &messages[i]); err != nil {
+			response.Results[i].Status = BulkImportFailed
+			response.Results[i].Error = "Invalid message"
+			continue
+		}
+
+		m := &messages[i]
+		response.Results[i].ExternalId = m.ExternalId
+
+		if m.Type == "" {
+			m.Type = "md"
+		}
+		if !slices.Contains(messageTypes, m.Type) {
+			response.Results[i].Status = BulkImportFailed
+			response.Results[i].Error = "Invalid message type"
+			continue
+		}
+		if m.Timestamp.IsZero() {
+			response.Results[i].Status = BulkImportFailed
+			response.Results[i].Error = "Missing timestamp"
+			continue
+		}
+
+		order = append(order, i)
+	}
+
+	slices.SortStableFunc(order, func(a, b int) int {
+		return messages[a].Timestamp.Compare(messages[b].Timestamp)
+	})
+
+	for _, i := range order {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		message, existing, err := importMessage(ctx, messages[i], "", true)
+		cancel()
+
+		result := &response.Results[i]
+		switch {
+		case err != nil:
+			log.Printf("Failed to import message %d: %v\n", i, err)
+			result.Status = BulkImportFailed
+			result.Error = "Failed to save message"
+		case existing:
+			result.Status = BulkImportExisting
+			result.ID = message.ID
+		default:
+			result.Status = BulkImportCreated
+			result.ID = message.ID
+		}
+	}
+
+	for _, result := range response.Results {
+		switch result.Status {
+		case BulkImportCreated:
+			response.Created++
+		case BulkImportExisting:
+			response.Existing++
+		default:
+			response.Failed++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// readBulkImportItems splits the body into raw items, so one malformed message
+// fails on its own instead of failing the whole request.
+func readBulkImportItems(body io.Reader) ([]json.RawMessage, error) {
+	reader := bufio.NewReader(body)
+
+	first, err := peekFirstByte(reader)
+	if err != nil {
+		return nil, errors.New("empty request body")
+	}
+
+	if first == '[' {
+		var items []json.RawMessage
+		if err := json.NewDecoder(reader).Decode(&items); err != nil {
+			if errors.As(err, &maxBytesReader) {
+				return nil, err
+			}
+			return nil, errors.New("invalid JSON array")
+		}
+		return items, nil
+	}
+
+	items := []json.RawMessage{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, json.RawMessage(bytes.Clone(line)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func peekFirstByte(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\n' && b != '\r' && b != '\t' {
+			return b, reader.UnreadByte()
+		}
+	}
+}
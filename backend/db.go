@@ -3,15 +3,19 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/icza/dyno"
 	"github.com/redis/go-redis/v9"
+
+	"channel/activitypub"
 )
 
 var redisType = os.Getenv("REDIS_PROTOCOL")
@@ -19,6 +23,11 @@ var redisAddr = os.Getenv("REDIS_ADDR")
 var redisPass = os.Getenv("REDIS_PASSWORD")
 var rdb *redis.Client
 
+const (
+	eventsStreamKey    = "events:stream"
+	eventsStreamMaxLen = 1000
+)
+
 type Message struct {
 	ID        int          `json:"id" redis:"id"`
 	Type      string       `json:"type" redis:"type"`
@@ -27,11 +36,32 @@ type Message struct {
 	AuthorId  string       `json:"authorId" redis:"authorId"`
 	Timestamp time.Time    `json:"timestamp" redis:"timestamp"`
 	LastEdit  time.Time    `json:"last_edit" redis:"last_edit"`
-	File      FileResponse `json:"file" redis:"-"`
+	File      FileResponse `json:"file" redis:"file"`
 	Deleted   bool         `json:"deleted" redis:"deleted"`
 	Views     int          `json:"views" redis:"views"`
 	Reactions Reactions    `json:"reactions" redis:"reactions"`
 	IsAds     bool         `json:"is_ads" redis:"is_ads"`
+
+	// Version goes up with every edit, clients send it back in If-Match.
+	Version int `json:"version" redis:"version"`
+
+	ExternalId string `json:"externalId,omitempty" redis:"externalId,omitempty"`
+
+	// who made the last edit that changed the content
+	LastEditorId string `json:"lastEditorId,omitempty" redis:"lastEditorId,omitempty"`
+	LastEditor   string `json:"lastEditor,omitempty" redis:"lastEditor,omitempty"`
+
+	ReplyTo int           `json:"replyTo,omitempty" redis:"replyTo,omitempty"`
+	Reply   *ReplyPreview `json:"reply,omitempty" redis:"-"`
+
+	// Pin state is written on its own by dbPinMessage, so saving an edited
+	// message never changes it.
+	Pinned       bool       `json:"pinned,omitempty" redis:"-"`
+	PinnedAt     *time.Time `json:"pinnedAt,omitempty" redis:"-"`
+	PinExpiresAt *time.Time `json:"pinExpiresAt,omitempty" redis:"-"`
+
+	// DeletedAt is written by funcDeleteMessage and cleared on restore.
+	DeletedAt *time.Time `json:"deletedAt,omitempty" redis:"-"`
 }
 
 type User struct {
@@ -75,14 +105,64 @@ func getMessageNextId(ctx context.Context) int {
 }
 
 func setMessage(ctx context.Context, m *Message, isUpdate bool) error {
-	messageKey := fmt.Sprintf("messages:%d", m.ID)
+	if err := storeMessage(ctx, m, isUpdate); err != nil {
+		return err
+	}
+
+	pushType := "new-message"
+	if isUpdate {
+		pushType = "edit-message"
+	}
+
+	publishMessage(ctx, m, pushType)
+
+	return nil
+}
+
+// editMessage saves an edit of an existing message, keeps the replaced content
+// in its history and publishes it, see dbUpdateMessage.
+func editMessage(ctx context.Context, before, m *Message, ifVersion *int) error {
+	if err := dbUpdateMessage(ctx, before, m, ifVersion); err != nil {
+		return err
+	}
+
+	recordMessageRevision(ctx, before, m)
+
+	publishMessage(ctx, m, "edit-message")
+
+	return nil
+}
+
+func publishMessage(ctx context.Context, m *Message, pushType string) {
+	if m.ReplyTo != 0 {
+		messages := []Message{*m}
+		attachReplyPreviews(ctx, messages, false)
+		m.Reply = messages[0].Reply
+	}
+
+	pushMessage := PushMessage{
+		Type: pushType,
+		M:    *m,
+	}
 
+	publishEvent(ctx, &pushMessage)
+}
+
+func applyRegexReplace(m *Message) {
 	for _, regex := range settingConfig.RegexReplace {
 		if !strings.HasPrefix(m.Text, "[quote-embedded#]") {
 			t := regex.Pattern.ReplaceAllString(m.Text, regex.Replace)
 			m.Text = t
 		}
 	}
+}
+
+// storeMessage saves the message and indexes it without publishing a live
+// event, for messages that are backfilled rather than posted.
+func storeMessage(ctx context.Context, m *Message, isUpdate bool) error {
+	messageKey := fmt.Sprintf("messages:%d", m.ID)
+
+	applyRegexReplace(m)
 
 	// Set message in hash
 	if err := rdb.HSet(ctx, messageKey, m).Err(); err != nil {
@@ -96,23 +176,194 @@ func setMessage(ctx context.Context, m *Message, isUpdate bool) error {
 		}
 	}
 
-	pushType := "new-message"
-	if isUpdate {
-		pushType = "edit-message"
+	if m.ReplyTo != 0 {
+		repliesKey := fmt.Sprintf("message:%d:replies", m.ReplyTo)
+		if err := rdb.ZAdd(ctx, repliesKey, redis.Z{Score: float64(m.Timestamp.Unix()), Member: messageKey}).Err(); err != nil {
+			return err
+		}
 	}
 
-	pushMessage := PushMessage{
-		Type: pushType,
-		M:    *m,
+	if err := dbIndexMessage(ctx, m.ID, m.Text, m.Timestamp); err != nil {
+		log.Printf("Failed to index message %d: %v\n", m.ID, err)
+	}
+
+	return nil
+}
+
+var (
+	errMessageNotFound        = errors.New("message not found")
+	errMessageVersionConflict = errors.New("message was changed by another edit")
+)
+
+// updateMessageScript writes the given fields only if the message exists and,
+// when ARGV[1] is not empty, its version is still ARGV[1]. Fields with an empty
+// value are removed. It returns the new version, -1 for a missing message and
+// -2 for a version mismatch.
+var updateMessageScript = redis.NewScript(`
+	if redis.call('EXISTS', KEYS[1]) == 0 then
+		return -1
+	end
+
+	if ARGV[1] ~= '' then
+		local version = redis.call('HGET', KEYS[1], 'version') or '0'
+		if version ~= ARGV[1] then
+			return -2
+		end
+	end
+
+	for i = 2, #ARGV, 2 do
+		if ARGV[i+1] == '' then
+			redis.call('HDEL', KEYS[1], ARGV[i])
+		else
+			redis.call('HSET', KEYS[1], ARGV[i], ARGV[i+1])
+		end
+	end
+
+	return redis.call('HINCRBY', KEYS[1], 'version', 1)
+`)
+
+// dbUpdateMessage saves the editable fields of m over the stored message,
+// leaving server-owned fields such as views, reactions and the author as they
+// are. before is the message as it was loaded, for moving the reply link. When
+// ifVersion is set the edit is rejected with errMessageVersionConflict if the
+// message changed since that version.
+func dbUpdateMessage(ctx context.Context, before, m *Message, ifVersion *int) error {
+	messageKey := fmt.Sprintf("messages:%d", m.ID)
+
+	applyRegexReplace(m)
+
+	expected := ""
+	if ifVersion != nil {
+		expected = strconv.Itoa(*ifVersion)
+	}
+
+	replyTo := ""
+	if m.ReplyTo != 0 {
+		replyTo = strconv.Itoa(m.ReplyTo)
+	}
+
+	args := []any{
+		expected,
+		"type", m.Type,
+		"text", m.Text,
+		"file", m.File,
+		"is_ads", m.IsAds,
+		"deleted", m.Deleted,
+		"last_edit", m.LastEdit,
+		"lastEditorId", m.LastEditorId,
+		"lastEditor", m.LastEditor,
+		"replyTo", replyTo,
+	}
+	if !m.Deleted {
+		args = append(args, "deletedAt", "")
+	}
+
+	version, err := updateMessageScript.Run(ctx, rdb, []string{messageKey}, args...).Int()
+	if err != nil {
+		return err
+	}
+	switch version {
+	case -1:
+		return errMessageNotFound
+	case -2:
+		return errMessageVersionConflict
+	}
+	m.Version = version
+
+	if !m.Deleted {
+		m.DeletedAt = nil
+	}
+	if before.Deleted && !m.Deleted {
+		rdb.ZRem(ctx, "deleted_messages", messageKey)
+	}
+
+	if before.ReplyTo != m.ReplyTo {
+		if before.ReplyTo != 0 {
+			rdb.ZRem(ctx, fmt.Sprintf("message:%d:replies", before.ReplyTo), messageKey)
+		}
+		if m.ReplyTo != 0 {
+			repliesKey := fmt.Sprintf("message:%d:replies", m.ReplyTo)
+			if err := rdb.ZAdd(ctx, repliesKey, redis.Z{Score: float64(m.Timestamp.Unix()), Member: messageKey}).Err(); err != nil {
+				return err
+			}
+		}
 	}
 
-	pushMessageData, _ := json.Marshal(pushMessage)
-	rdb.Publish(ctx, "events", pushMessageData)
+	if err := dbIndexMessage(ctx, m.ID, m.Text, m.Timestamp); err != nil {
+		log.Printf("Failed to index message %d: %v\n", m.ID, err)
+	}
 
 	return nil
 }
 
-func setReaction(ctx context.Context, messageId int, emoji string, userId string) error {
+// publishEvent appends a live event to the capped events stream. The stream
+// entry ID is sent to SSE clients so they can resume after a reconnect.
+func publishEvent(ctx context.Context, pushMessage *PushMessage) {
+	pushMessageData, err := json.Marshal(pushMessage)
+	if err != nil {
+		log.Printf("Failed to marshal event: %v\n", err)
+		return
+	}
+
+	err = rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: eventsStreamKey,
+		MaxLen: eventsStreamMaxLen,
+		Approx: true,
+		Values: map[string]any{"data": pushMessageData},
+	}).Err()
+	if err != nil {
+		log.Printf("Failed to publish event: %v\n", err)
+	}
+}
+
+func dbGetLastEventId(ctx context.Context) (string, error) {
+	events, err := rdb.XRevRangeN(ctx, eventsStreamKey, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(events) == 0 {
+		return "0-0", nil
+	}
+
+	return events[0].ID, nil
+}
+
+// dbGetEventsAfter returns the events stored after lastId, oldest first.
+func dbGetEventsAfter(ctx context.Context, lastId string) ([]redis.XMessage, error) {
+	events, err := rdb.XRange(ctx, eventsStreamKey, lastId, "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(events) > 0 && events[0].ID == lastId {
+		events = events[1:]
+	}
+
+	return events, nil
+}
+
+// dbReadEvents waits up to block for events newer than lastId.
+func dbReadEvents(ctx context.Context, lastId string, block time.Duration) ([]redis.XMessage, error) {
+	res, err := rdb.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{eventsStreamKey, lastId},
+		Count:   100,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+
+	return res[0].Messages, nil
+}
+
+// setReaction toggles the user's reaction and returns the new totals and
+// whether the reaction was removed.
+func setReaction(ctx context.Context, messageId int, emoji string, userId string) (Reactions, bool, error) {
 	kay := fmt.Sprintf("message:%d:reactions", messageId)
 	userId = fmt.Sprintf("%v", userId)
 
@@ -122,26 +373,27 @@ func setReaction(ctx context.Context, messageId int, emoji string, userId string
 
 	prevReact, err := rdb.HGet(ctx, kay, userId).Result()
 	if err != nil && err != redis.Nil {
-		return fmt.Errorf("failed to get previous reaction: %v", err)
+		return nil, false, fmt.Errorf("failed to get previous reaction: %v", err)
 	}
 
-	if prevReact == emoji {
+	removed := prevReact == emoji
+	if removed {
 		react = map[string]string{
 			userId: "",
 		}
 	}
 
 	if err := rdb.HSet(ctx, kay, react).Err(); err != nil {
-		return err
+		return nil, false, err
 	}
 
 	r, err := funcGetSumReactions(ctx, messageId)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	if err := updateMessageReactions(ctx, messageId, r); err != nil {
-		return err
+		return nil, false, err
 	}
 
 	pushMessage := PushMessage{
@@ -152,108 +404,392 @@ func setReaction(ctx context.Context, messageId int, emoji string, userId string
 		},
 	}
 
-	pushMessageData, _ := json.Marshal(pushMessage)
-	rdb.Publish(ctx, "events", pushMessageData)
+	publishEvent(ctx, &pushMessage)
 
-	return nil
+	return r, removed, nil
 }
 
-var getMessageRange = redis.NewScript(`
-	local time_set_key = KEYS[1]
-	local offset_key = KEYS[2]
+// luaDecodeMessage defines decode_message, which loads a message hash and
+// applies the visibility rules for the requesting user. Every script that
+// returns messages to clients is prefixed with it.
+const luaDecodeMessage = `
+	local function decode_message(message_key, isAdmin, countViews)
+		local message_data = redis.call('HGETALL', message_key)
+		local message = {}
+
+		for j = 1, #message_data, 2 do
+			local key = message_data[j]
+			local value = message_data[j+1]
+
+			if key == 'id' or key == 'replyTo' or key == 'version' then
+				message[key] = tonumber(value)
+			elseif key == 'views' then
+				if countViews then
+					message[key] = tonumber(value)
+				else
+					message[key] = 0
+				end
+			elseif key == 'deleted' then
+				message[key] = value == '1'
+			elseif key == 'author' then
+			    if isAdmin then
+			        message[key] = value
+			    else
+			        message[key] = "Anonymous"
+			    end
+			elseif key == 'authorId' then
+				if isAdmin then
+				   message[key] = value
+				else
+				   message[key] = "Anonymous"
+				end
+			elseif key == 'lastEditor' or key == 'lastEditorId' then
+				if isAdmin then
+				   message[key] = value
+				end
+			elseif key == 'reactions' then
+			    local success, parsedReactions = pcall(cjson.decode, value)
+				if success then
+					message[key] = parsedReactions
+				else
+					message[key] = {}
+				end
+			elseif key == 'file' then
+				local success, parsedFile = pcall(cjson.decode, value)
+				if success then
+					message[key] = parsedFile
+				end
+			elseif key == 'is_ads' or key == 'pinned' then
+			    message[key] = value == '1'
+			else
+				message[key] = value
+			end
+		end
 
-	local required_length = tonumber(ARGV[1])
-	local isAdmin = ARGV[2] == 'true'
-	local countViews = ARGV[3] == 'true'
-	local direction = ARGV[4] or 'desc'
+		return message
+	end
+`
 
+var getMessageScript = redis.NewScript(luaDecodeMessage + `
+	if redis.call('EXISTS', KEYS[1]) == 0 then
+		return nil
+	end
 
-	local start_index
-	if direction == 'asc' then
-	    start_index = redis.call('ZRANK', time_set_key, offset_key) or 0
-	else
-	    start_index = redis.call('ZREVRANK', time_set_key, offset_key) or 0
+	return cjson.encode(decode_message(KEYS[1], ARGV[1] == 'true', ARGV[2] == 'true'))
+`)
+
+// dbGetMessage returns nil when the message does not exist. Deleted messages
+// are returned to admins only.
+func dbGetMessage(ctx context.Context, id int, isAdmin, countViews bool) (*Message, error) {
+	res, err := getMessageScript.Run(ctx, rdb, []string{fmt.Sprintf("messages:%d", id)}, []string{strconv.FormatBool(isAdmin), strconv.FormatBool(countViews)}).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	jsonMessage, _ := dyno.GetString(res)
+
+	var m Message
+	if err := json.Unmarshal([]byte(jsonMessage), &m); err != nil {
+		return nil, err
+	}
+
+	if m.Deleted && !isAdmin {
+		return nil, nil
+	}
+
+	return &m, nil
+}
+
+// Modes of dbGetMessagePage.
+const (
+	pageLatest = "latest"
+	pageBefore = "before"
+	pageAfter  = "after"
+	pageAround = "around"
+	pageDate   = "date"
+)
+
+var errCursorNotFound = errors.New("cursor message not found")
+
+// getMessagePageScript pages through the timeline by rank, newest rank 0.
+// Deleted messages are skipped for non-admins, so one more visible message
+// than needed is collected on each side to tell whether there are more. It
+// returns an empty reply when the cursor is not in the timeline.
+var getMessagePageScript = redis.NewScript(luaDecodeMessage + `
+	local time_set_key = KEYS[1]
+
+	local mode = ARGV[1]
+	local cursor = ARGV[2]
+	local limit = tonumber(ARGV[3])
+	local isAdmin = ARGV[4] == 'true'
+	local countViews = ARGV[5] == 'true'
+
+	local total = redis.call('ZCARD', time_set_key)
+
+	-- collect reads up to count visible messages from rank start, older
+	-- (step 1) or newer (step -1), closest to start first.
+	local function collect(start, step, count)
+		local found = {}
+		local rank = start
+		while #found < count and rank >= 0 and rank < total do
+			local batch = count - #found
+			local keys = {}
+			if step > 0 then
+				keys = redis.call('ZREVRANGE', time_set_key, rank, rank + batch - 1)
+				rank = rank + batch
+			else
+				local low = math.max(rank - batch + 1, 0)
+				local range = redis.call('ZREVRANGE', time_set_key, low, rank)
+				for i = #range, 1, -1 do
+					table.insert(keys, range[i])
+				end
+				rank = low - 1
+			end
+
+			for _, message_key in ipairs(keys) do
+				local message = decode_message(message_key, isAdmin, countViews)
+				if message['id'] and (not message['deleted'] or isAdmin) then
+					table.insert(found, message)
+				end
+			end
+		end
+		return found
 	end
 
-	if start_index > 0 then
-		start_index = start_index + 1
+	local function cursor_rank(message_key)
+		return redis.call('ZREVRANK', time_set_key, message_key)
 	end
 
-	local messages = {}
-	repeat
-		local batch_size = required_length - #messages
-		local stop_index = start_index + batch_size
-		local message_ids
-		
-		if direction == 'asc' then
-		 message_ids = redis.call('ZRANGE', time_set_key, start_index, stop_index)
+	local newer = {}
+	local center = nil
+	local older = {}
+	local has_before = false
+	local has_after = false
+	local anchor = 0
+
+	if mode == 'date' then
+		local first = redis.call('ZRANGEBYSCORE', time_set_key, cursor, '+inf', 'LIMIT', 0, 1)
+		if #first == 0 then
+			mode = 'latest'
 		else
-		 message_ids = redis.call('ZREVRANGE', time_set_key, start_index, stop_index)
+			mode = 'around'
+			cursor = first[1]
 		end
+	end
 
-		if #message_ids == 0 then
-			break
+	if mode == 'latest' then
+		older = collect(0, 1, limit + 1)
+		has_before = #older > limit
+		if has_before then
+			table.remove(older)
+		end
+	else
+		local rank
+		if mode == 'after' and cursor == 'messages:0' then
+			-- after 0 starts from the oldest message
+			rank = total
+		else
+			rank = cursor_rank(cursor)
+			if not rank then
+				return {}
+			end
 		end
 
-		for i, message_key in ipairs(message_ids) do
-			local message_data = redis.call('HGETALL', message_key)
-			local message = {}
-	
-			for j = 1, #message_data, 2 do
-				local key = message_data[j]
-				local value = message_data[j+1]
-	
-				if key == 'id' then
-					message[key] = tonumber(value)
-                elseif key == 'views' then
-					if countViews then
-						message[key] = tonumber(value)
-					else
-						message[key] = 0	
-					end
-				elseif key == 'deleted' then
-					message[key] = value == '1'
-				elseif key == 'author' then
-				    if isAdmin then
-				        message[key] = value
-				    else
-				        message[key] = "Anonymous"
-				    end
-				elseif key == 'authorId' then
-					if isAdmin then
-					   message[key] = value
-                    else
-                       message[key] = "Anonymous"
-                    end
-				elseif key == 'reactions' then
-				    local success, parsedReactions = pcall(cjson.decode, value)
-					if success then
-						message[key] = parsedReactions
-					else
-						message[key] = {}
-					end
-				elseif key == 'is_ads' then
-				    message[key] = value == '1'
-				else
-					message[key] = value
-				end
+		if mode == 'before' then
+			older = collect(rank + 1, 1, limit + 1)
+			has_before = #older > limit
+			if has_before then
+				table.remove(older)
 			end
-	
-			if not message['deleted'] or isAdmin then
-				table.insert(messages, message)
+			has_after = #collect(rank, -1, 1) > 0
+		elseif mode == 'after' then
+			newer = collect(rank - 1, -1, limit + 1)
+			has_after = #newer > limit
+			if has_after then
+				table.remove(newer)
+			end
+			has_before = #collect(rank, 1, 1) > 0
+		else
+			local message = decode_message(cursor, isAdmin, countViews)
+			if message['id'] and (not message['deleted'] or isAdmin) then
+				center = message
+				anchor = message['id']
+			end
+
+			local want = limit
+			if center then
+				want = want - 1
+			end
+
+			-- half of the window on each side, a short side leaves more
+			-- room for the other
+			newer = collect(rank - 1, -1, want + 1)
+			older = collect(rank + 1, 1, want + 1)
+			local keep_newer = math.min(#newer, math.max(math.floor(want / 2), want - #older))
+			local keep_older = math.min(#older, want - keep_newer)
+			has_after = #newer > keep_newer
+			has_before = #older > keep_older
+			while #newer > keep_newer do
+				table.remove(newer)
+			end
+			while #older > keep_older do
+				table.remove(older)
 			end
 		end
+	end
 
-		start_index = start_index + batch_size
+	local messages = {}
+	for i = #newer, 1, -1 do
+		table.insert(messages, newer[i])
+	end
+	if center then
+		table.insert(messages, center)
+	end
+	for _, message in ipairs(older) do
+		table.insert(messages, message)
+	end
 
-	until #messages >= required_length
+	local flags = {0, 0}
+	if has_before then
+		flags[1] = 1
+	end
+	if has_after then
+		flags[2] = 1
+	end
+
+	return {cjson.encode(messages), flags[1], flags[2], anchor}
+`)
+
+// MessagePage is a window of the timeline, newest message first.
+type MessagePage struct {
+	Messages      []Message `json:"messages"`
+	HasMoreBefore bool      `json:"hasMoreBefore"`
+	HasMoreAfter  bool      `json:"hasMoreAfter"`
+	// Anchor is the message the window was built around, for around and
+	// date pages.
+	Anchor int `json:"anchor,omitempty"`
+}
+
+// dbGetMessagePage returns limit messages of the timeline. cursor is a message
+// id for before, after and around pages and ignored for latest pages; an after
+// page with cursor 0 is the oldest messages. Date pages are built around the
+// first message posted at or after date. It returns errCursorNotFound when the
+// cursor message is not in the timeline.
+func dbGetMessagePage(ctx context.Context, mode string, cursor int, date time.Time, limit int64, isAdmin, countViews bool) (*MessagePage, error) {
+	arg := fmt.Sprintf("messages:%d", cursor)
+	if mode == pageDate {
+		arg = strconv.FormatInt(date.Unix(), 10)
+	}
+
+	res, err := getMessagePageScript.Run(ctx, rdb, []string{"m_times:1"}, mode, arg, limit, strconv.FormatBool(isAdmin), strconv.FormatBool(countViews)).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 4 {
+		return nil, errCursorNotFound
+	}
+
+	page := &MessagePage{Messages: []Message{}}
+	if resStr, _ := res[0].(string); resStr != "{}" {
+		if err := json.Unmarshal([]byte(resStr), &page.Messages); err != nil {
+			return nil, err
+		}
+	}
+	hasBefore, _ := res[1].(int64)
+	hasAfter, _ := res[2].(int64)
+	anchor, _ := res[3].(int64)
+	page.HasMoreBefore = hasBefore == 1
+	page.HasMoreAfter = hasAfter == 1
+	page.Anchor = int(anchor)
+
+	return page, nil
+}
+
+// dbGetNearestMessageId returns the closest message to id that is still in
+// the timeline, newer or older than it, or 0 when there is none. Message ids
+// follow the timeline, so it walks them in batches.
+func dbGetNearestMessageId(ctx context.Context, id int, newer bool) (int, error) {
+	last, err := rdb.Get(ctx, "message:next_id").Int()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	step := -1
+	if newer {
+		step = 1
+	}
+	next := id + step
+	if !newer && next > last {
+		next = last
+	}
+
+	const batchSize = 100
+	for next >= 1 && next <= last {
+		pipe := rdb.Pipeline()
+		ids := []int{}
+		scores := []*redis.FloatCmd{}
+		for ; next >= 1 && next <= last && len(ids) < batchSize; next += step {
+			ids = append(ids, next)
+			scores = append(scores, pipe.ZScore(ctx, "m_times:1", fmt.Sprintf("messages:%d", next)))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return 0, err
+		}
+
+		for i, score := range scores {
+			if score.Err() == nil {
+				return ids[i], nil
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// getMessageListScript reads the messages of a sorted set of message keys,
+// like the replies to a message or the pinned messages.
+var getMessageListScript = redis.NewScript(luaDecodeMessage + `
+	local list_key = KEYS[1]
+
+	local start_index = tonumber(ARGV[1])
+	local required_length = tonumber(ARGV[2])
+	local isAdmin = ARGV[3] == 'true'
+	local countViews = ARGV[4] == 'true'
+	local direction = ARGV[5] or 'asc'
+
+	local message_keys
+	if direction == 'asc' then
+		message_keys = redis.call('ZRANGE', list_key, 0, -1)
+	else
+		message_keys = redis.call('ZREVRANGE', list_key, 0, -1)
+	end
+	local messages = {}
+	local skipped = 0
+	for i, message_key in ipairs(message_keys) do
+		if #messages >= required_length then
+			break
+		end
+
+		local message = decode_message(message_key, isAdmin, countViews)
+		if message['id'] and (not message['deleted'] or isAdmin) then
+			if skipped < start_index then
+				skipped = skipped + 1
+			else
+				table.insert(messages, message)
+			end
+		end
+	end
 
 	return cjson.encode(messages)
 `)
 
-func funcGetMessageRange(ctx context.Context, start, stop int64, isAdmin, countViews bool, direction string) ([]Message, error) {
-	offsetKeyName := fmt.Sprintf("messages:%d", start)
-	res, err := getMessageRange.Run(ctx, rdb, []string{"m_times:1", offsetKeyName}, []string{strconv.FormatInt(stop, 10), strconv.FormatBool(isAdmin), strconv.FormatBool(countViews), direction}).Result()
+// dbGetMessageList returns the messages of a sorted set of message keys.
+// offset counts the messages the viewer can see.
+func dbGetMessageList(ctx context.Context, key string, offset, limit int64, isAdmin, countViews bool, direction string) ([]Message, error) {
+	res, err := getMessageListScript.Run(ctx, rdb, []string{key}, []string{strconv.FormatInt(offset, 10), strconv.FormatInt(limit, 10), strconv.FormatBool(isAdmin), strconv.FormatBool(countViews), direction}).Result()
 	if err != nil {
 		return []Message{}, err
 	}
@@ -271,24 +807,253 @@ func funcGetMessageRange(ctx context.Context, start, stop int64, isAdmin, countV
 	return messages, nil
 }
 
-var sumMessageReactions = redis.NewScript(`
-  local reactions = redis.call('HVALS', KEYS[1])
-  local result = {}
+// dbGetReplies returns the replies to a message, oldest first.
+func dbGetReplies(ctx context.Context, id int, offset, limit int64, isAdmin, countViews bool) ([]Message, error) {
+	return dbGetMessageList(ctx, fmt.Sprintf("message:%d:replies", id), offset, limit, isAdmin, countViews, "asc")
+}
 
-   for _, reaction in ipairs(reactions) do
-   if reaction ~= "" then
-    if result[reaction] then
-	  result[reaction] = result[reaction] + 1
-    else
-	  result[reaction] = 1
-   end
-    end
-  end 
-  return cjson.encode(result)
+// dbGetReplyPreviews reads the originals of replies in one round trip. A
+// missing original is reported as deleted.
+func dbGetReplyPreviews(ctx context.Context, ids []int, isAdmin bool) (map[int]*ReplyPreview, error) {
+	pipe := rdb.Pipeline()
+	cmds := make(map[int]*redis.SliceCmd, len(ids))
+	for _, id := range ids {
+		if _, ok := cmds[id]; !ok {
+			cmds[id] = pipe.HMGet(ctx, fmt.Sprintf("messages:%d", id), "id", "text", "deleted")
+		}
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	previews := make(map[int]*ReplyPreview, len(cmds))
+	for id, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) != 3 || fields[0] == nil {
+			previews[id] = newReplyPreview(id, "", true, isAdmin)
+			continue
+		}
+
+		text, _ := fields[1].(string)
+		previews[id] = newReplyPreview(id, text, fields[2] == "1", isAdmin)
+	}
+
+	return previews, nil
+}
+
+// getSitemapEntriesScript returns the id, timestamp and last edit of the
+// messages in a rank range of the timeline, oldest first, skipping deleted ones.
+var getSitemapEntriesScript = redis.NewScript(`
+	local message_keys = redis.call('ZRANGE', KEYS[1], ARGV[1], ARGV[2])
+	local entries = {}
+	for i, message_key in ipairs(message_keys) do
+		local fields = redis.call('HMGET', message_key, 'id', 'timestamp', 'last_edit', 'deleted')
+		if fields[1] and fields[4] ~= '1' then
+			table.insert(entries, {fields[1], fields[2] or '', fields[3] or ''})
+		end
+	end
+
+	return entries
+`)
+
+func dbGetSitemapEntries(ctx context.Context, start, stop int64) ([]SitemapEntry, error) {
+	res, err := getSitemapEntriesScript.Run(ctx, rdb, []string{"m_times:1"}, start, stop).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]SitemapEntry, 0, len(res))
+	for _, item := range res {
+		fields, ok := item.([]any)
+		if !ok || len(fields) != 3 {
+			continue
+		}
+
+		id, _ := strconv.Atoi(fmt.Sprint(fields[0]))
+		entry := SitemapEntry{ID: id}
+		entry.Timestamp, _ = time.Parse(time.RFC3339Nano, fmt.Sprint(fields[1]))
+		entry.LastEdit, _ = time.Parse(time.RFC3339Nano, fmt.Sprint(fields[2]))
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func dbCountMessages(ctx context.Context) (int64, error) {
+	return rdb.ZCard(ctx, "m_times:1").Result()
+}
+
+var searchMessagesScript = redis.NewScript(luaDecodeMessage + `
+	local result_key = KEYS[1]
+	local offset_key = ARGV[1]
+
+	local required_length = tonumber(ARGV[2])
+	local isAdmin = ARGV[3] == 'true'
+	local countViews = ARGV[4] == 'true'
+
+	local intersect = {'ZINTERSTORE', result_key, #KEYS - 1}
+	for i = 2, #KEYS do
+		table.insert(intersect, KEYS[i])
+	end
+	table.insert(intersect, 'AGGREGATE')
+	table.insert(intersect, 'MAX')
+	redis.call(unpack(intersect))
+
+	local start_index = 0
+	if offset_key ~= '' then
+		start_index = redis.call('ZREVRANK', result_key, offset_key)
+		if not start_index then
+			redis.call('DEL', result_key)
+			return false
+		end
+		start_index = start_index + 1
+	end
+
+	local messages = {}
+	repeat
+		local message_ids = redis.call('ZREVRANGE', result_key, start_index, start_index + required_length - 1)
+		if #message_ids == 0 then
+			break
+		end
+
+		for i, message_key in ipairs(message_ids) do
+			local message = decode_message(message_key, isAdmin, countViews)
+
+			if message['id'] and (not message['deleted'] or isAdmin) and #messages < required_length then
+				table.insert(messages, message)
+			end
+		end
+
+		start_index = start_index + required_length
+	until #messages >= required_length
+
+	redis.call('DEL', result_key)
+
+	return cjson.encode(messages)
+`)
+
+// dbSearchMessages returns up to limit messages matching all terms, newest
+// first, after the message offset. It returns errCursorNotFound when offset is
+// not one of the results, for example after the message was edited.
+func dbSearchMessages(ctx context.Context, terms []string, offset, limit int64, isAdmin, countViews bool) ([]Message, error) {
+	keys := []string{fmt.Sprintf("search:result:%s", generatedRandomID(8))}
+	for _, term := range terms {
+		keys = append(keys, fmt.Sprintf("search:term:%s", term))
+	}
+
+	offsetKeyName := ""
+	if offset > 0 {
+		offsetKeyName = fmt.Sprintf("messages:%d", offset)
+	}
+	res, err := searchMessagesScript.Run(ctx, rdb, keys, []string{offsetKeyName, strconv.FormatInt(limit, 10), strconv.FormatBool(isAdmin), strconv.FormatBool(countViews)}).Result()
+	if err == redis.Nil {
+		return []Message{}, errCursorNotFound
+	}
+	if err != nil {
+		return []Message{}, err
+	}
+
+	if res == "{}" {
+		return []Message{}, nil
+	}
+
+	var messages []Message
+	resStr, _ := dyno.GetString(res)
+	if err := json.Unmarshal([]byte(resStr), &messages); err != nil {
+		return []Message{}, err
+	}
+
+	return messages, nil
+}
+
+// dbIndexMessage replaces the search terms stored for a message. The score of
+// every term entry is the message timestamp so results come back newest first.
+func dbIndexMessage(ctx context.Context, id int, text string, timestamp time.Time) error {
+	messageKey := fmt.Sprintf("messages:%d", id)
+	termsKey := fmt.Sprintf("message:%d:terms", id)
+
+	score := float64(timestamp.Unix())
+	if s, err := rdb.ZScore(ctx, "m_times:1", messageKey).Result(); err == nil {
+		score = s
+	}
+
+	oldTerms, err := rdb.SMembers(ctx, termsKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	terms := searchTerms(text)
+	keep := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		keep[term] = true
+	}
+
+	pipe := rdb.Pipeline()
+	for _, term := range oldTerms {
+		if !keep[term] {
+			pipe.ZRem(ctx, fmt.Sprintf("search:term:%s", term), messageKey)
+		}
+	}
+	pipe.Del(ctx, termsKey)
+	for _, term := range terms {
+		pipe.ZAdd(ctx, fmt.Sprintf("search:term:%s", term), redis.Z{Score: score, Member: messageKey})
+		pipe.SAdd(ctx, termsKey, term)
+	}
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// applyMessageVisibility mirrors decode_message for messages that do not come
+// from a script, such as live events. It reports whether the message may be
+// shown to the viewer at all.
+func applyMessageVisibility(m *Message, isAdmin, countViews bool) bool {
+	if !countViews {
+		m.Views = 0
+	}
+
+	if isAdmin {
+		return true
+	}
+
+	m.Author = "Anonymous"
+	m.AuthorId = "Anonymous"
+	m.LastEditor = ""
+	m.LastEditorId = ""
+
+	if m.Deleted {
+		m.Text = ""
+		m.File = FileResponse{}
+		return false
+	}
+
+	return true
+}
+
+var sumMessageReactions = redis.NewScript(`
+  local reactions = redis.call('HVALS', KEYS[1])
+  local imported = redis.call('HGETALL', KEYS[2])
+  local result = {}
+
+  for i = 1, #imported, 2 do
+    result[imported[i]] = tonumber(imported[i+1])
+  end
+
+   for _, reaction in ipairs(reactions) do
+   if reaction ~= "" then
+    if result[reaction] then
+	  result[reaction] = result[reaction] + 1
+    else
+	  result[reaction] = 1
+   end
+    end
+  end 
+  return cjson.encode(result)
 `)
 
 func funcGetSumReactions(ctx context.Context, messageId int) (Reactions, error) {
-	res, err := sumMessageReactions.Run(ctx, rdb, []string{fmt.Sprintf("message:%d:reactions", messageId)}).Result()
+	res, err := sumMessageReactions.Run(ctx, rdb, []string{fmt.Sprintf("message:%d:reactions", messageId), fmt.Sprintf("message:%d:imported_reactions", messageId)}).Result()
 	if err != nil || res == nil || res == "{}" {
 		return nil, err
 	}
@@ -327,13 +1092,24 @@ func updateMessageReactions(ctx context.Context, messageId int, reactions Reacti
 
 func funcDeleteMessage(ctx context.Context, id string) error {
 	msgKey := fmt.Sprintf("messages:%s", id)
-	rdb.HSet(ctx, msgKey, "deleted", true)
+	now := time.Now()
+
+	// the trash keeps the time of the first delete, for the retention policy.
+	// the message stays in the search index: writers can still find it, the
+	// search script hides it from everyone else and purging removes it
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, msgKey, "deleted", true)
+	pipe.HSetNX(ctx, msgKey, "deletedAt", now.Format(time.RFC3339Nano))
+	pipe.ZAddNX(ctx, "deleted_messages", redis.Z{Score: float64(now.Unix()), Member: msgKey})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
 
 	var m Message
 	idInt, _ := strconv.Atoi(id)
 	m.ID = idInt
 	m.Deleted = true
-	m.LastEdit = time.Now()
+	m.LastEdit = now
 	m.Text = "*ההודעה נמחקה*"
 	m.File = FileResponse{}
 
@@ -341,8 +1117,7 @@ func funcDeleteMessage(ctx context.Context, id string) error {
 		Type: "delete-message",
 		M:    m,
 	}
-	pushMessageData, _ := json.Marshal(pushMessage)
-	rdb.Publish(ctx, "events", pushMessageData)
+	publishEvent(ctx, &pushMessage)
 
 	return nil
 }
@@ -695,3 +1470,979 @@ func dbGetScheduledMessages(ctx context.Context) (*[]Message, error) {
 
 	return &messages, nil
 }
+
+func dbGetWebhookSubscriptions(ctx context.Context) ([]*WebhookSubscription, error) {
+	jsonList, err := rdb.Get(ctx, "webhooks:list").Result()
+	if err != nil {
+		if err == redis.Nil {
+			return []*WebhookSubscription{}, nil
+		}
+		return nil, fmt.Errorf("failed to get webhooks from db: %v", err)
+	}
+
+	var subscriptions []*WebhookSubscription
+	if err := json.Unmarshal([]byte(jsonList), &subscriptions); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal webhooks: %v", err)
+	}
+
+	return subscriptions, nil
+}
+
+func dbSetWebhookSubscriptions(ctx context.Context, subscriptions []*WebhookSubscription) error {
+	jsonList, err := json.Marshal(subscriptions)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhooks: %v", err)
+	}
+
+	if err := rdb.Set(ctx, "webhooks:list", jsonList, 0).Err(); err != nil {
+		return fmt.Errorf("failed to set webhooks in db: %v", err)
+	}
+
+	return nil
+}
+
+func dbCreateWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	id, err := rdb.Incr(ctx, "webhook:delivery:next_id").Result()
+	if err != nil {
+		return err
+	}
+	d.ID = id
+
+	jsonDelivery, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook delivery: %v", err)
+	}
+
+	if err := rdb.Set(ctx, fmt.Sprintf("webhook:delivery:%d", id), jsonDelivery, 0).Err(); err != nil {
+		return err
+	}
+
+	if err := rdb.ZAdd(ctx, "webhook:deliveries", redis.Z{Score: float64(d.CreatedAt.Unix()), Member: id}).Err(); err != nil {
+		return err
+	}
+
+	return rdb.ZAdd(ctx, "webhook:outbox", redis.Z{Score: float64(d.NextAttemptAt.Unix()), Member: id}).Err()
+}
+
+// dbUpdateWebhookDelivery saves the delivery state, appends the attempt to its
+// log when given, and keeps the outbox in sync with the status.
+func dbUpdateWebhookDelivery(ctx context.Context, d *WebhookDelivery, attempt *WebhookAttempt) error {
+	jsonDelivery, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook delivery: %v", err)
+	}
+
+	if err := rdb.Set(ctx, fmt.Sprintf("webhook:delivery:%d", d.ID), jsonDelivery, 0).Err(); err != nil {
+		return err
+	}
+
+	if attempt != nil {
+		jsonAttempt, err := json.Marshal(attempt)
+		if err != nil {
+			return fmt.Errorf("failed to marshal webhook attempt: %v", err)
+		}
+		if err := rdb.RPush(ctx, fmt.Sprintf("webhook:delivery:%d:attempts", d.ID), jsonAttempt).Err(); err != nil {
+			return err
+		}
+	}
+
+	if d.Status == DeliveryPending {
+		return rdb.ZAdd(ctx, "webhook:outbox", redis.Z{Score: float64(d.NextAttemptAt.Unix()), Member: d.ID}).Err()
+	}
+
+	return rdb.ZRem(ctx, "webhook:outbox", d.ID).Err()
+}
+
+func dbGetWebhookDelivery(ctx context.Context, id int64, withAttempts bool) (*WebhookDelivery, error) {
+	jsonDelivery, err := rdb.Get(ctx, fmt.Sprintf("webhook:delivery:%d", id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var d WebhookDelivery
+	if err := json.Unmarshal([]byte(jsonDelivery), &d); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal webhook delivery: %v", err)
+	}
+
+	if !withAttempts {
+		return &d, nil
+	}
+
+	attempts, err := rdb.LRange(ctx, fmt.Sprintf("webhook:delivery:%d:attempts", id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	d.History = []WebhookAttempt{}
+	for _, a := range attempts {
+		var attempt WebhookAttempt
+		if err := json.Unmarshal([]byte(a), &attempt); err == nil {
+			d.History = append(d.History, attempt)
+		}
+	}
+
+	return &d, nil
+}
+
+// dbGetWebhookDeliveries returns the latest deliveries, only those with the
+// given status unless it is empty. Deliveries are read in batches until limit
+// of them match, since the status is not indexed.
+func dbGetWebhookDeliveries(ctx context.Context, status DeliveryStatus, limit int64) ([]*WebhookDelivery, error) {
+	deliveries := []*WebhookDelivery{}
+	for start := int64(0); int64(len(deliveries)) < limit; start += limit {
+		ids, err := rdb.ZRevRange(ctx, "webhook:deliveries", start, start+limit-1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			idInt, _ := strconv.ParseInt(id, 10, 64)
+			d, err := dbGetWebhookDelivery(ctx, idInt, false)
+			if err != nil {
+				continue
+			}
+			if status != "" && d.Status != status {
+				continue
+			}
+			deliveries = append(deliveries, d)
+			if int64(len(deliveries)) == limit {
+				break
+			}
+		}
+
+		if int64(len(ids)) < limit {
+			break
+		}
+	}
+
+	return deliveries, nil
+}
+
+var claimWebhookDeliveriesScript = redis.NewScript(`
+	local outbox_key = KEYS[1]
+	local now = ARGV[1]
+	local lease_until = ARGV[2]
+	local limit = tonumber(ARGV[3])
+
+	local due = redis.call('ZRANGEBYSCORE', outbox_key, '-inf', now, 'LIMIT', 0, limit)
+	for _, id in ipairs(due) do
+		redis.call('ZADD', outbox_key, lease_until, id)
+	end
+
+	return due
+`)
+
+// dbClaimWebhookDeliveries returns the IDs of due deliveries and pushes them
+// forward by lease, so another worker does not pick them up meanwhile and a
+// delivery interrupted by a restart is retried once the lease ends.
+func dbClaimWebhookDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int64) ([]int64, error) {
+	res, err := claimWebhookDeliveriesScript.Run(ctx, rdb, []string{"webhook:outbox"}, []string{
+		strconv.FormatInt(now.Unix(), 10),
+		strconv.FormatInt(now.Add(lease).Unix(), 10),
+		strconv.FormatInt(limit, 10),
+	}).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0, len(res))
+	for _, id := range res {
+		if idInt, err := strconv.ParseInt(id, 10, 64); err == nil {
+			ids = append(ids, idInt)
+		}
+	}
+
+	return ids, nil
+}
+
+// dbTrimWebhookDeliveries removes the oldest finished deliveries beyond keep.
+func dbTrimWebhookDeliveries(ctx context.Context, keep int64) error {
+	ids, err := rdb.ZRange(ctx, "webhook:deliveries", 0, -keep-1).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		idInt, _ := strconv.ParseInt(id, 10, 64)
+		d, err := dbGetWebhookDelivery(ctx, idInt, false)
+		if err == nil && d.Status == DeliveryPending {
+			continue
+		}
+
+		rdb.Del(ctx, fmt.Sprintf("webhook:delivery:%s", id), fmt.Sprintf("webhook:delivery:%s:attempts", id))
+		rdb.ZRem(ctx, "webhook:deliveries", id)
+		rdb.ZRem(ctx, "webhook:outbox", id)
+	}
+
+	return nil
+}
+
+func dbCreateApiKey(ctx context.Context, k *ApiKey) error {
+	jsonKey, err := json.Marshal(k)
+	if err != nil {
+		return fmt.Errorf("failed to marshal API key: %v", err)
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("api_keys:%s", k.ID), jsonKey, 0)
+	pipe.Set(ctx, fmt.Sprintf("api_keys:hash:%s", k.Hash), k.ID, 0)
+	pipe.SAdd(ctx, "api_keys:list", k.ID)
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+func dbGetApiKey(ctx context.Context, id string) (*ApiKey, error) {
+	jsonKey, err := rdb.Get(ctx, fmt.Sprintf("api_keys:%s", id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var k ApiKey
+	if err := json.Unmarshal([]byte(jsonKey), &k); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal API key: %v", err)
+	}
+
+	lastUsed, err := rdb.HGet(ctx, "api_keys:last_used", id).Int64()
+	if err == nil {
+		k.LastUsedAt = time.Unix(lastUsed, 0)
+	}
+
+	return &k, nil
+}
+
+// dbGetApiKeyByHash returns nil when no key has the given hash.
+func dbGetApiKeyByHash(ctx context.Context, hash string) (*ApiKey, error) {
+	id, err := rdb.Get(ctx, fmt.Sprintf("api_keys:hash:%s", hash)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return dbGetApiKey(ctx, id)
+}
+
+func dbGetApiKeys(ctx context.Context) ([]*ApiKey, error) {
+	ids, err := rdb.SMembers(ctx, "api_keys:list").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*ApiKey{}
+	for _, id := range ids {
+		k, err := dbGetApiKey(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if k != nil {
+			keys = append(keys, k)
+		}
+	}
+
+	slices.SortFunc(keys, func(a, b *ApiKey) int { return b.CreatedAt.Compare(a.CreatedAt) })
+
+	return keys, nil
+}
+
+// dbRevokeApiKey marks the key as revoked and removes its hash, so it stops
+// working right away but stays listed for reference.
+func dbRevokeApiKey(ctx context.Context, id string, now time.Time) (bool, error) {
+	k, err := dbGetApiKey(ctx, id)
+	if err != nil || k == nil {
+		return false, err
+	}
+
+	k.RevokedAt = now
+	jsonKey, err := json.Marshal(k)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal API key: %v", err)
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("api_keys:%s", k.ID), jsonKey, 0)
+	pipe.Del(ctx, fmt.Sprintf("api_keys:hash:%s", k.Hash))
+	_, err = pipe.Exec(ctx)
+
+	return true, err
+}
+
+func dbTouchApiKey(id string, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := rdb.HSet(ctx, "api_keys:last_used", id, now.Unix()).Err(); err != nil {
+		log.Printf("Failed to update API key last use: %v\n", err)
+	}
+}
+
+// dbReserveImportKey claims an import key for a new message. When the key is
+// already taken it returns the message ID stored under it, or 0 while the
+// first request is still creating the message.
+func dbReserveImportKey(ctx context.Context, key string) (bool, int, error) {
+	reserved, err := rdb.SetNX(ctx, key, 0, importPendingTTL).Result()
+	if err != nil || reserved {
+		return reserved, 0, err
+	}
+
+	id, err := rdb.Get(ctx, key).Int()
+	if err == redis.Nil {
+		return dbReserveImportKey(ctx, key)
+	}
+
+	return false, id, err
+}
+
+// dbSetImportKey points the key at the created message. A ttl of 0 keeps it
+// forever.
+func dbSetImportKey(ctx context.Context, key string, id int, ttl time.Duration) error {
+	return rdb.Set(ctx, key, id, ttl).Err()
+}
+
+func dbReleaseImportKey(ctx context.Context, key string) {
+	rdb.Del(ctx, key)
+}
+
+func dbGetMessageIdByExternalId(ctx context.Context, externalId string) (int, error) {
+	id, err := rdb.Get(ctx, externalIdKey(externalId)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return id, err
+}
+
+// dbSetImportedReactions keeps reaction counts brought from another platform,
+// where the reacting users are unknown. They are added to the local reactions.
+func dbSetImportedReactions(ctx context.Context, messageId int, reactions Reactions) error {
+	if len(reactions) == 0 {
+		return nil
+	}
+
+	counts := make(map[string]any, len(reactions))
+	for emoji, count := range reactions {
+		counts[emoji] = count
+	}
+
+	return rdb.HSet(ctx, fmt.Sprintf("message:%d:imported_reactions", messageId), counts).Err()
+}
+
+// KeyDump is one database key in a backup archive. Value holds a string, a
+// map for hashes, a list of members for sets and lists, and ZMembers for
+// sorted sets.
+type KeyDump struct {
+	Key      string            `json:"key"`
+	Type     string            `json:"type"`
+	Value    any               `json:"value,omitempty"`
+	ZMembers []redis.Z         `json:"zmembers,omitempty"`
+	Hash     map[string]string `json:"hash,omitempty"`
+}
+
+func dbScanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := rdb.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	return keys, iter.Err()
+}
+
+// dbDumpKey returns nil when the key does not exist.
+func dbDumpKey(ctx context.Context, key string) (*KeyDump, error) {
+	keyType, err := rdb.Type(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &KeyDump{Key: key, Type: keyType}
+	switch keyType {
+	case "none":
+		return nil, nil
+	case "string":
+		dump.Value, err = rdb.Get(ctx, key).Result()
+	case "hash":
+		dump.Hash, err = rdb.HGetAll(ctx, key).Result()
+	case "set":
+		dump.Value, err = rdb.SMembers(ctx, key).Result()
+	case "list":
+		dump.Value, err = rdb.LRange(ctx, key, 0, -1).Result()
+	case "zset":
+		dump.ZMembers, err = rdb.ZRangeWithScores(ctx, key, 0, -1).Result()
+	default:
+		return nil, fmt.Errorf("unsupported type %s for key %s", keyType, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return dump, nil
+}
+
+func dbRestoreKey(ctx context.Context, dump *KeyDump) error {
+	switch dump.Type {
+	case "string":
+		value, _ := dump.Value.(string)
+		return rdb.Set(ctx, dump.Key, value, 0).Err()
+	case "hash":
+		if len(dump.Hash) == 0 {
+			return nil
+		}
+		return rdb.HSet(ctx, dump.Key, dump.Hash).Err()
+	case "set":
+		members := dumpMembers(dump.Value)
+		if len(members) == 0 {
+			return nil
+		}
+		return rdb.SAdd(ctx, dump.Key, members...).Err()
+	case "list":
+		members := dumpMembers(dump.Value)
+		if len(members) == 0 {
+			return nil
+		}
+		return rdb.RPush(ctx, dump.Key, members...).Err()
+	case "zset":
+		if len(dump.ZMembers) == 0 {
+			return nil
+		}
+		return rdb.ZAdd(ctx, dump.Key, dump.ZMembers...).Err()
+	default:
+		return fmt.Errorf("unsupported type %s for key %s", dump.Type, dump.Key)
+	}
+}
+
+func dumpMembers(value any) []any {
+	list, _ := value.([]any)
+	return list
+}
+
+// dbGetFeedToken returns the feed token of the user, creating it on first use.
+func dbGetFeedToken(ctx context.Context, email string) (string, error) {
+	userKey := fmt.Sprintf("feed_tokens:user:%s", email)
+
+	token, err := rdb.Get(ctx, userKey).Result()
+	if err == nil {
+		return token, nil
+	}
+	if err != redis.Nil {
+		return "", err
+	}
+
+	token = generatedRandomID(20)
+	if token == "" {
+		return "", fmt.Errorf("failed to generate feed token")
+	}
+
+	created, err := rdb.SetNX(ctx, userKey, token, 0).Result()
+	if err != nil {
+		return "", err
+	}
+	if !created {
+		return rdb.Get(ctx, userKey).Result()
+	}
+
+	return token, rdb.Set(ctx, fmt.Sprintf("feed_tokens:%s", token), email, 0).Err()
+}
+
+// dbResetFeedToken replaces the feed token of the user, the old one stops
+// working right away.
+func dbResetFeedToken(ctx context.Context, email string) (string, error) {
+	userKey := fmt.Sprintf("feed_tokens:user:%s", email)
+
+	old, err := rdb.Get(ctx, userKey).Result()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+
+	token := generatedRandomID(20)
+	if token == "" {
+		return "", fmt.Errorf("failed to generate feed token")
+	}
+
+	pipe := rdb.TxPipeline()
+	if old != "" {
+		pipe.Del(ctx, fmt.Sprintf("feed_tokens:%s", old))
+	}
+	pipe.Set(ctx, userKey, token, 0)
+	pipe.Set(ctx, fmt.Sprintf("feed_tokens:%s", token), email, 0)
+	_, err = pipe.Exec(ctx)
+
+	return token, err
+}
+
+// dbGetFeedTokenUser returns the email of the token owner, or "" when the
+// token is not valid. A token is valid while it is still the current token
+// of a user who is registered on the channel.
+func dbGetFeedTokenUser(ctx context.Context, token string) (string, error) {
+	email, err := rdb.Get(ctx, fmt.Sprintf("feed_tokens:%s", token)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	pipe := rdb.Pipeline()
+	current := pipe.Get(ctx, fmt.Sprintf("feed_tokens:user:%s", email))
+	registered := pipe.SIsMember(ctx, "registered_emails", email)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return "", err
+	}
+	if current.Val() != token || !registered.Val() {
+		return "", nil
+	}
+
+	return email, nil
+}
+
+// dbGetActivityPubKey returns "" when the actor has no key yet.
+func dbGetActivityPubKey(ctx context.Context) (string, error) {
+	key, err := rdb.Get(ctx, "activitypub:private_key").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	return key, err
+}
+
+// dbSetActivityPubKey stores the key unless another instance stored one
+// first, and returns the key that was kept.
+func dbSetActivityPubKey(ctx context.Context, key string) (string, error) {
+	created, err := rdb.SetNX(ctx, "activitypub:private_key", key, 0).Result()
+	if err != nil {
+		return "", err
+	}
+	if !created {
+		return rdb.Get(ctx, "activitypub:private_key").Result()
+	}
+
+	return key, nil
+}
+
+func dbAddActivityPubFollower(ctx context.Context, f *Follower) error {
+	jsonFollower, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("failed to marshal follower: %v", err)
+	}
+
+	return rdb.HSet(ctx, "activitypub:followers", f.Actor, jsonFollower).Err()
+}
+
+func dbRemoveActivityPubFollower(ctx context.Context, actor string) error {
+	return rdb.HDel(ctx, "activitypub:followers", actor).Err()
+}
+
+func dbGetActivityPubFollowers(ctx context.Context) ([]*Follower, error) {
+	values, err := rdb.HVals(ctx, "activitypub:followers").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	followers := []*Follower{}
+	for _, value := range values {
+		var f Follower
+		if err := json.Unmarshal([]byte(value), &f); err == nil {
+			followers = append(followers, &f)
+		}
+	}
+
+	slices.SortFunc(followers, func(a, b *Follower) int { return a.FollowedAt.Compare(b.FollowedAt) })
+
+	return followers, nil
+}
+
+func dbCountActivityPubFollowers(ctx context.Context) (int64, error) {
+	return rdb.HLen(ctx, "activitypub:followers").Result()
+}
+
+// dbGetCachedActivityPubActor returns nil when the actor is not cached.
+func dbGetCachedActivityPubActor(ctx context.Context, id string) (*activitypub.Actor, error) {
+	jsonActor, err := rdb.Get(ctx, fmt.Sprintf("activitypub:actors:%s", id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var actor activitypub.Actor
+	if err := json.Unmarshal([]byte(jsonActor), &actor); err != nil {
+		return nil, nil
+	}
+
+	return &actor, nil
+}
+
+func dbCacheActivityPubActor(ctx context.Context, actor *activitypub.Actor, ttl time.Duration) error {
+	jsonActor, err := json.Marshal(actor)
+	if err != nil {
+		return err
+	}
+
+	return rdb.Set(ctx, fmt.Sprintf("activitypub:actors:%s", actor.ID), jsonActor, ttl).Err()
+}
+
+// dbActivityPubActorFailed reports whether fetching the actor failed within
+// the failure TTL.
+func dbActivityPubActorFailed(ctx context.Context, id string) (bool, error) {
+	n, err := rdb.Exists(ctx, fmt.Sprintf("activitypub:actor_failures:%s", id)).Result()
+	return n == 1, err
+}
+
+func dbSetActivityPubActorFailed(ctx context.Context, id string, ttl time.Duration) error {
+	return rdb.Set(ctx, fmt.Sprintf("activitypub:actor_failures:%s", id), 1, ttl).Err()
+}
+
+func dbCreateActivityPubDelivery(ctx context.Context, d *ActivityPubDelivery) error {
+	id, err := rdb.Incr(ctx, "activitypub:delivery:next_id").Result()
+	if err != nil {
+		return err
+	}
+	d.ID = id
+
+	return dbUpdateActivityPubDelivery(ctx, d)
+}
+
+func dbUpdateActivityPubDelivery(ctx context.Context, d *ActivityPubDelivery) error {
+	jsonDelivery, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ActivityPub delivery: %v", err)
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("activitypub:delivery:%d", d.ID), jsonDelivery, 0)
+	pipe.ZAdd(ctx, "activitypub:queue", redis.Z{Score: float64(d.NextAttemptAt.Unix()), Member: d.ID})
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+// dbGetActivityPubDelivery returns nil when the delivery no longer exists.
+func dbGetActivityPubDelivery(ctx context.Context, id int64) (*ActivityPubDelivery, error) {
+	jsonDelivery, err := rdb.Get(ctx, fmt.Sprintf("activitypub:delivery:%d", id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var d ActivityPubDelivery
+	if err := json.Unmarshal([]byte(jsonDelivery), &d); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ActivityPub delivery: %v", err)
+	}
+
+	return &d, nil
+}
+
+func dbDeleteActivityPubDelivery(ctx context.Context, id int64) error {
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, fmt.Sprintf("activitypub:delivery:%d", id))
+	pipe.ZRem(ctx, "activitypub:queue", id)
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+// dbClaimActivityPubDeliveries works like dbClaimWebhookDeliveries on the
+// ActivityPub queue.
+func dbClaimActivityPubDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int64) ([]int64, error) {
+	res, err := claimWebhookDeliveriesScript.Run(ctx, rdb, []string{"activitypub:queue"}, []string{
+		strconv.FormatInt(now.Unix(), 10),
+		strconv.FormatInt(now.Add(lease).Unix(), 10),
+		strconv.FormatInt(limit, 10),
+	}).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0, len(res))
+	for _, id := range res {
+		if idInt, err := strconv.ParseInt(id, 10, 64); err == nil {
+			ids = append(ids, idInt)
+		}
+	}
+
+	return ids, nil
+}
+
+// dbPinMessage pins the message, or updates the expiry of a pinned one. A nil
+// expiresAt keeps it pinned until it is unpinned.
+func dbPinMessage(ctx context.Context, id int, pinnedAt time.Time, expiresAt *time.Time) error {
+	messageKey := fmt.Sprintf("messages:%d", id)
+
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, messageKey, "pinned", true, "pinnedAt", pinnedAt.Format(time.RFC3339Nano))
+		pipe.ZAdd(ctx, "pinned_messages", redis.Z{Score: float64(pinnedAt.Unix()), Member: messageKey})
+		if expiresAt != nil {
+			pipe.HSet(ctx, messageKey, "pinExpiresAt", expiresAt.Format(time.RFC3339Nano))
+			pipe.ZAdd(ctx, "pinned_messages:expires", redis.Z{Score: float64(expiresAt.Unix()), Member: messageKey})
+		} else {
+			pipe.HDel(ctx, messageKey, "pinExpiresAt")
+			pipe.ZRem(ctx, "pinned_messages:expires", messageKey)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// dbUnpinMessage reports whether the message was pinned.
+func dbUnpinMessage(ctx context.Context, id int) (bool, error) {
+	messageKey := fmt.Sprintf("messages:%d", id)
+
+	var removed *redis.IntCmd
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.ZRem(ctx, "pinned_messages", messageKey)
+		pipe.ZRem(ctx, "pinned_messages:expires", messageKey)
+		pipe.HDel(ctx, messageKey, "pinned", "pinnedAt", "pinExpiresAt")
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return removed.Val() > 0, nil
+}
+
+// dbGetPinnedMessages returns the pinned messages, the latest pin first.
+func dbGetPinnedMessages(ctx context.Context, isAdmin, countViews bool) ([]Message, error) {
+	return dbGetMessageList(ctx, "pinned_messages", 0, maxPinnedMessages, isAdmin, countViews, "desc")
+}
+
+func dbGetExpiredPins(ctx context.Context, now time.Time) ([]int, error) {
+	keys, err := rdb.ZRangeByScore(ctx, "pinned_messages:expires", &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(now.Unix(), 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(keys))
+	for _, key := range keys {
+		if id, err := strconv.Atoi(strings.TrimPrefix(key, "messages:")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func dbCountPinnedMessages(ctx context.Context) (int64, error) {
+	return rdb.ZCard(ctx, "pinned_messages").Result()
+}
+
+// dbAddMessageRevision appends to the message history and returns the
+// revision number, counted from 1. The number is the position in the list, so
+// it is not stored.
+func dbAddMessageRevision(ctx context.Context, id int, rev *MessageRevision) (int, error) {
+	data, err := json.Marshal(rev)
+	if err != nil {
+		return 0, err
+	}
+
+	length, err := rdb.RPush(ctx, fmt.Sprintf("message:%d:revisions", id), data).Result()
+	if err != nil {
+		return 0, err
+	}
+	rev.Revision = int(length)
+
+	return rev.Revision, nil
+}
+
+func dbGetMessageRevisions(ctx context.Context, id int) ([]MessageRevision, error) {
+	values, err := rdb.LRange(ctx, fmt.Sprintf("message:%d:revisions", id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]MessageRevision, 0, len(values))
+	for i, value := range values {
+		var rev MessageRevision
+		if err := json.Unmarshal([]byte(value), &rev); err != nil {
+			log.Printf("Failed to decode revision %d of message %d: %v\n", i+1, id, err)
+			continue
+		}
+		rev.Revision = i + 1
+		revisions = append(revisions, rev)
+	}
+
+	return revisions, nil
+}
+
+// dbGetMessageRevision returns nil when there is no such revision.
+func dbGetMessageRevision(ctx context.Context, id, revision int) (*MessageRevision, error) {
+	if revision < 1 {
+		return nil, nil
+	}
+
+	value, err := rdb.LIndex(ctx, fmt.Sprintf("message:%d:revisions", id), int64(revision-1)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rev MessageRevision
+	if err := json.Unmarshal([]byte(value), &rev); err != nil {
+		return nil, err
+	}
+	rev.Revision = revision
+
+	return &rev, nil
+}
+
+// dbGetDeletedMessages returns the messages in the trash, the latest delete
+// first.
+func dbGetDeletedMessages(ctx context.Context, offset, limit int64, countViews bool) ([]Message, error) {
+	return dbGetMessageList(ctx, "deleted_messages", offset, limit, true, countViews, "desc")
+}
+
+func dbCountDeletedMessages(ctx context.Context) (int64, error) {
+	return rdb.ZCard(ctx, "deleted_messages").Result()
+}
+
+// dbGetExpiredDeletedMessages returns the ids of the messages deleted before
+// the given time, at most limit of them.
+func dbGetExpiredDeletedMessages(ctx context.Context, before time.Time, limit int64) ([]int, error) {
+	keys, err := rdb.ZRangeByScore(ctx, "deleted_messages", &redis.ZRangeBy{Min: "-inf", Max: "(" + strconv.FormatInt(before.Unix(), 10), Count: limit}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(keys))
+	for _, key := range keys {
+		if id, err := strconv.Atoi(strings.TrimPrefix(key, "messages:")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+var restoreDeletedMessageScript = redis.NewScript(`
+	local in_trash = redis.call('ZREM', KEYS[1], KEYS[2]) == 1
+	if not in_trash or redis.call('EXISTS', KEYS[2]) == 0 then
+		return -1
+	end
+
+	redis.call('HSET', KEYS[2], 'deleted', '0')
+	redis.call('HDEL', KEYS[2], 'deletedAt')
+	return redis.call('HINCRBY', KEYS[2], 'version', 1)
+`)
+
+// dbRestoreDeletedMessage takes the message out of the trash and returns its
+// new version. It returns errMessageNotFound when the message is not deleted.
+func dbRestoreDeletedMessage(ctx context.Context, id int) (int, error) {
+	messageKey := fmt.Sprintf("messages:%d", id)
+
+	version, err := restoreDeletedMessageScript.Run(ctx, rdb, []string{"deleted_messages", messageKey}).Int()
+	if err != nil {
+		return 0, err
+	}
+	if version == -1 {
+		return 0, errMessageNotFound
+	}
+
+	return version, nil
+}
+
+// dbPurgeMessage removes the message and everything stored for it: reactions,
+// replies list, edit history, pin, search terms, the reply link to its
+// original and the external id it was imported with.
+func dbPurgeMessage(ctx context.Context, m *Message) error {
+	messageKey := fmt.Sprintf("messages:%d", m.ID)
+	termsKey := fmt.Sprintf("message:%d:terms", m.ID)
+
+	terms, err := rdb.SMembers(ctx, termsKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	externalKey := ""
+	if m.ExternalId != "" {
+		if id, err := dbGetMessageIdByExternalId(ctx, m.ExternalId); err == nil && id == m.ID {
+			externalKey = externalIdKey(m.ExternalId)
+		}
+	}
+
+	pipe := rdb.TxPipeline()
+	for _, term := range terms {
+		pipe.ZRem(ctx, fmt.Sprintf("search:term:%s", term), messageKey)
+	}
+	for _, key := range []string{"m_times:1", "deleted_messages", "pinned_messages", "pinned_messages:expires"} {
+		pipe.ZRem(ctx, key, messageKey)
+	}
+	if m.ReplyTo != 0 {
+		pipe.ZRem(ctx, fmt.Sprintf("message:%d:replies", m.ReplyTo), messageKey)
+	}
+	if externalKey != "" {
+		pipe.Del(ctx, externalKey)
+	}
+	pipe.Del(ctx,
+		messageKey,
+		termsKey,
+		fmt.Sprintf("message:%d:reactions", m.ID),
+		fmt.Sprintf("message:%d:imported_reactions", m.ID),
+		fmt.Sprintf("message:%d:replies", m.ID),
+		fmt.Sprintf("message:%d:revisions", m.ID),
+	)
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// dbGetFilesInUse returns which of fileIds are still linked from a message in
+// the timeline, deleted or not, or from its edit history. Files are not
+// reference counted, so the timeline is scanned in batches.
+func dbGetFilesInUse(ctx context.Context, fileIds []string) (map[string]bool, error) {
+	inUse := make(map[string]bool)
+	check := func(value string) {
+		for _, fileId := range fileIds {
+			if !inUse[fileId] && strings.Contains(value, fileId) {
+				inUse[fileId] = true
+			}
+		}
+	}
+
+	var start int64
+	const batchSize = 500
+	for len(inUse) < len(fileIds) {
+		keys, err := rdb.ZRange(ctx, "m_times:1", start, start+batchSize-1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		pipe := rdb.Pipeline()
+		fields := make([]*redis.SliceCmd, len(keys))
+		revisions := make([]*redis.StringSliceCmd, len(keys))
+		for i, key := range keys {
+			fields[i] = pipe.HMGet(ctx, key, "text", "file")
+			revisions[i] = pipe.LRange(ctx, strings.Replace(key, "messages:", "message:", 1)+":revisions", 0, -1)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, err
+		}
+
+		for i := range keys {
+			for _, value := range fields[i].Val() {
+				if value, ok := value.(string); ok {
+					check(value)
+				}
+			}
+			for _, rev := range revisions[i].Val() {
+				check(rev)
+			}
+		}
+
+		if len(keys) < batchSize {
+			break
+		}
+		start += batchSize
+	}
+
+	return inUse, nil
+}
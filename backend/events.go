@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icza/dyno"
+	"github.com/redis/go-redis/v9"
+)
+
+// eventClientBuffer is how many events may wait for a client before it is
+// considered too slow and disconnected. Disconnected clients resume from
+// their last event ID when they reconnect.
+const eventClientBuffer = 64
+
+var eventIdPattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// Event is a stream entry rendered for a specific viewer.
+type Event struct {
+	ID   string
+	Data []byte
+}
+
+type EventClient struct {
+	IsAdmin bool
+	Events  chan Event
+}
+
+// preparedEvent holds one stream entry rendered once for each kind of viewer,
+// so the payload is not decoded again for every connected client.
+type preparedEvent struct {
+	id     string
+	admin  []byte
+	public []byte // nil when non-privileged viewers must not receive it
+}
+
+// EventHub reads the events stream once per server instance and fans the
+// events out to every connected client.
+type EventHub struct {
+	mu      sync.Mutex
+	clients map[*EventClient]struct{}
+}
+
+var eventHub = &EventHub{
+	clients: make(map[*EventClient]struct{}),
+}
+
+func (h *EventHub) Subscribe(isAdmin bool) *EventClient {
+	c := &EventClient{
+		IsAdmin: isAdmin,
+		Events:  make(chan Event, eventClientBuffer),
+	}
+
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+
+	increaseCounterSSE()
+
+	return c
+}
+
+func (h *EventHub) Unsubscribe(c *EventClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(c)
+}
+
+// remove must be called with h.mu held.
+func (h *EventHub) remove(c *EventClient) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	close(c.Events)
+	decreaseCounterSSE()
+}
+
+func (h *EventHub) broadcast(x redis.XMessage) {
+	prepared := prepareEvent(x)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		event, ok := prepared.forViewer(c.IsAdmin)
+		if !ok {
+			continue
+		}
+
+		select {
+		case c.Events <- event:
+		default:
+			h.remove(c)
+		}
+	}
+}
+
+func (h *EventHub) Run() {
+	var lastId string
+	for lastId == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		id, err := dbGetLastEventId(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to get last event id: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		lastId = id
+	}
+
+	for {
+		events, err := dbReadEvents(context.Background(), lastId, 5*time.Second)
+		if err != nil {
+			log.Printf("Failed to read events: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, event := range events {
+			h.broadcast(event)
+			lastId = event.ID
+		}
+	}
+}
+
+// subscribeEvents registers a client with the hub and loads the events stored
+// after lastEventId. The client is registered first so no event falls between
+// the replay and the live feed; callers skip live events that are not newer
+// than the returned ID.
+func subscribeEvents(ctx context.Context, lastEventId string, isAdmin bool) (*EventClient, []Event, string, error) {
+	client := eventHub.Subscribe(isAdmin)
+
+	if !eventIdPattern.MatchString(lastEventId) {
+		return client, nil, "0-0", nil
+	}
+
+	stored, err := dbGetEventsAfter(ctx, lastEventId)
+	if err != nil {
+		eventHub.Unsubscribe(client)
+		return nil, nil, "", err
+	}
+
+	replay := make([]Event, 0, len(stored))
+	for _, x := range stored {
+		if event, ok := prepareEvent(x).forViewer(isAdmin); ok {
+			replay = append(replay, event)
+		}
+		lastEventId = x.ID
+	}
+
+	return client, replay, lastEventId, nil
+}
+
+// prepareEvent applies the same visibility rules as getMessagePageScript to the
+// event payload. Delete events still reach every viewer so they can drop the
+// message, but without its content.
+func prepareEvent(x redis.XMessage) preparedEvent {
+	prepared := preparedEvent{id: x.ID}
+
+	data, _ := dyno.GetString(x.Values["data"])
+	var pushMessage PushMessage
+	if err := json.Unmarshal([]byte(data), &pushMessage); err != nil {
+		log.Printf("Failed to decode event %s: %v\n", x.ID, err)
+		return prepared
+	}
+
+	admin := pushMessage
+	applyMessageVisibility(&admin.M, true, settingConfig.CountViews)
+	prepared.admin, _ = json.Marshal(admin)
+
+	public := pushMessage
+	visible := applyMessageVisibility(&public.M, false, settingConfig.CountViews)
+	if visible || public.Type == "delete-message" {
+		prepared.public, _ = json.Marshal(public)
+	}
+
+	return prepared
+}
+
+func (p preparedEvent) forViewer(isAdmin bool) (Event, bool) {
+	data := p.public
+	if isAdmin {
+		data = p.admin
+	}
+
+	return Event{ID: p.id, Data: data}, data != nil
+}
+
+// eventIdAfter reports whether stream entry ID a is newer than b.
+func eventIdAfter(a, b string) bool {
+	aMs, aSeq := parseEventId(a)
+	bMs, bSeq := parseEventId(b)
+	if aMs != bMs {
+		return aMs > bMs
+	}
+	return aSeq > bSeq
+}
+
+func parseEventId(id string) (uint64, uint64) {
+	ms, seq, _ := strings.Cut(id, "-")
+	msInt, _ := strconv.ParseUint(ms, 10, 64)
+	seqInt, _ := strconv.ParseUint(seq, 10, 64)
+	return msInt, seqInt
+}
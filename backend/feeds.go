@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"channel/markdown"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	feedItemsLimit  = 50
+	feedTitleLength = 80
+
+	// defaultFeedTitle names a channel that has neither a name nor a
+	// project_domain.
+	defaultFeedTitle = "Channel"
+)
+
+// Feed is the channel as a feed, before it is written in one of the formats.
+type Feed struct {
+	Title       string
+	Description string
+	SiteURL     string
+	SelfURL     string
+	Logo        string
+	Updated     time.Time
+	Items       []FeedItem
+}
+
+type FeedItem struct {
+	ID         int
+	URL        string
+	Title      string
+	HTML       string
+	Published  time.Time
+	Updated    time.Time
+	Enclosures []FeedEnclosure
+}
+
+type FeedEnclosure struct {
+	URL      string
+	Filename string
+	MimeType string
+	Size     int64
+}
+
+// projectURL returns project_domain as a URL without a trailing slash, or ""
+// when it is not set. Links are relative then, since the Host header of the
+// request is up to the client.
+func projectURL() string {
+	domain := strings.TrimSuffix(settingConfig.ProjectDomain, "/")
+	if domain != "" && !strings.Contains(domain, "://") {
+		domain = "https://" + domain
+	}
+
+	return domain
+}
+
+func messageURL(base string, id int) string {
+	return base + "/message/" + strconv.Itoa(id)
+}
+
+// ifRequireAuthOrFeedToken works like ifRequireAuth, and also lets in feed
+// readers, which cannot log in, with the feed token of a user. The user is
+// looked up on every request, so a replaced token or a user who is no longer
+// registered stops working right away.
+func ifRequireAuthOrFeedToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !settingConfig.RequireAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if token := r.URL.Query().Get("token"); token != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			email, err := dbGetFeedTokenUser(ctx, token)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to check feed token: %v\n", err)
+				http.Error(w, "error", http.StatusInternalServerError)
+				return
+			}
+			if email != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		checkLogin(next).ServeHTTP(w, r)
+	})
+}
+
+// buildFeed loads the latest messages as an anonymous viewer sees them.
+func buildFeed(r *http.Request) (*Feed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := getChannelDetails(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := dbGetMessagePage(ctx, pageLatest, 0, time.Time{}, feedItemsLimit, false, false)
+	if err != nil {
+		return nil, err
+	}
+	messages := page.Messages
+
+	base := projectURL()
+
+	// Readers of a feed that requires auth fetch its files with the same
+	// token as the feed itself, from the route that only serves those.
+	token := ""
+	if settingConfig.RequireAuth {
+		token = r.URL.Query().Get("token")
+	}
+	resolve := func(u string) string {
+		if token != "" {
+			if fileId, ok := strings.CutPrefix(strings.TrimPrefix(u, base), "/api/files/"); ok {
+				u = "/api/feed/files/" + fileId + "?token=" + url.QueryEscape(token)
+			}
+		}
+		if strings.HasPrefix(u, "/") {
+			u = base + u
+		}
+		return u
+	}
+	renderer := markdown.Renderer{ResolveURL: resolve}
+
+	feed := &Feed{
+		Title:       c["name"],
+		Description: c["description"],
+		SiteURL:     base + "/",
+		SelfURL:     base + r.URL.Path,
+		Items:       []FeedItem{},
+	}
+	if feed.Title == "" {
+		feed.Title = defaultFeedTitle
+		if u, err := url.Parse(base); err == nil && u.Host != "" {
+			feed.Title = u.Host
+		}
+	}
+	if token != "" {
+		feed.SelfURL += "?token=" + url.QueryEscape(token)
+	}
+	if c["logoUrl"] != "" {
+		feed.Logo = resolve(c["logoUrl"])
+	}
+
+	for _, m := range messages {
+		if m.ID == 0 || len(feed.Items) >= feedItemsLimit {
+			continue
+		}
+
+		item := FeedItem{
+			ID:        m.ID,
+			URL:       messageURL(base, m.ID),
+			Title:     markdown.Excerpt(m.Text, feedTitleLength),
+			HTML:      renderer.ToHTML(m.Text),
+			Published: m.Timestamp,
+			Updated:   m.Timestamp,
+		}
+		if m.LastEdit.After(m.Timestamp) {
+			item.Updated = m.LastEdit
+		}
+		if item.Updated.After(feed.Updated) {
+			feed.Updated = item.Updated
+		}
+
+		for _, fileId := range messageFileIds(&m) {
+			info, err := getFileInfo(fileId)
+			if err != nil {
+				log.Printf("Failed to get file %s: %v\n", fileId, err)
+				continue
+			}
+			if info == nil {
+				continue
+			}
+			item.Enclosures = append(item.Enclosures, FeedEnclosure{
+				URL:      resolve("/api/files/" + info.ID),
+				Filename: info.Filename,
+				MimeType: info.MimeType,
+				Size:     info.Size,
+			})
+		}
+
+		feed.Items = append(feed.Items, item)
+	}
+
+	if feed.Updated.IsZero() {
+		feed.Updated = time.Now()
+	}
+
+	return feed, nil
+}
+
+// messageFileIds returns the uploaded files of the message, the attached one
+// first and then those embedded in the text.
+func messageFileIds(m *Message) []string {
+	ids := []string{}
+	seen := make(map[string]bool)
+	for _, match := range fileUrlPattern.FindAllStringSubmatch(m.File.URL+"\n"+m.Text, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			ids = append(ids, match[1])
+		}
+	}
+
+	return ids
+}
+
+// serveFeedFile serves the files of the feed, its logo and the files of the
+// messages in it, to readers with a feed token. Other files still need a login
+// on a channel that requires auth.
+func serveFeedFile(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fileId := chi.URLParam(r, "fileid")
+
+	c, err := getChannelDetails(ctx)
+	if err != nil {
+		log.Printf("Failed to get channel details: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if slices.Contains(messageFileIds(&Message{Text: c["logoUrl"]}), fileId) {
+		serveFile(w, r)
+		return
+	}
+
+	page, err := dbGetMessagePage(ctx, pageLatest, 0, time.Time{}, feedItemsLimit, false, false)
+	if err != nil {
+		log.Printf("Failed to get feed messages: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	for _, m := range page.Messages {
+		if m.ID != 0 && slices.Contains(messageFileIds(&m), fileId) {
+			serveFile(w, r)
+			return
+		}
+	}
+
+	http.Error(w, "File not found", http.StatusNotFound)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	Image         *rssImage `xml:"image,omitempty"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssImage struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title,omitempty"`
+	Link        string        `xml:"link"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Description string        `xml:"description"`
+	Enclosure   *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+func getRssFeed(w http.ResponseWriter, r *http.Request) {
+	feed, err := buildFeed(r)
+	if err != nil {
+		log.Printf("Failed to build feed: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	channel := rssChannel{
+		Title:         feed.Title,
+		Link:          feed.SiteURL,
+		Description:   feed.Description,
+		AtomLink:      atomLink{Href: feed.SelfURL, Rel: "self", Type: "application/rss+xml"},
+		LastBuildDate: feed.Updated.Format(time.RFC1123Z),
+	}
+	if feed.Logo != "" {
+		channel.Image = &rssImage{URL: feed.Logo, Title: feed.Title, Link: feed.SiteURL}
+	}
+
+	for _, item := range feed.Items {
+		rss := rssItem{
+			Title:       item.Title,
+			Link:        item.URL,
+			GUID:        rssGUID{IsPermaLink: true, Value: item.URL},
+			PubDate:     item.Published.Format(time.RFC1123Z),
+			Description: item.HTML,
+		}
+		// RSS allows a single enclosure, the rest are linked from the text.
+		if len(item.Enclosures) > 0 {
+			e := item.Enclosures[0]
+			rss.Enclosure = &rssEnclosure{URL: e.URL, Length: e.Size, Type: e.MimeType}
+		}
+		channel.Items = append(channel.Items, rss)
+	}
+
+	writeXMLFeed(w, "application/rss+xml", rssFeed{Version: "2.0", AtomNS: "http://www.w3.org/2005/Atom", Channel: channel})
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Logo     string      `xml:"logo,omitempty"`
+	Icon     string      `xml:"icon,omitempty"`
+	Author   atomAuthor  `xml:"author"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Title  string `xml:"title,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+func getAtomFeed(w http.ResponseWriter, r *http.Request) {
+	feed, err := buildFeed(r)
+	if err != nil {
+		log.Printf("Failed to build feed: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	atom := atomFeed{
+		Title:    feed.Title,
+		Subtitle: feed.Description,
+		ID:       feed.SiteURL,
+		Updated:  feed.Updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: feed.SiteURL},
+			{Href: feed.SelfURL, Rel: "self", Type: "application/atom+xml"},
+		},
+		Logo:   feed.Logo,
+		Icon:   feed.Logo,
+		Author: atomAuthor{Name: feed.Title},
+	}
+
+	for _, item := range feed.Items {
+		entry := atomEntry{
+			Title:     item.Title,
+			ID:        item.URL,
+			Published: item.Published.Format(time.RFC3339),
+			Updated:   item.Updated.Format(time.RFC3339),
+			Links:     []atomLink{{Href: item.URL, Rel: "alternate"}},
+			Content:   atomContent{Type: "html", Value: item.HTML},
+		}
+		// An entry must have a title, which a message with media only has not.
+		if entry.Title == "" {
+			entry.Title = fmt.Sprintf("#%d", item.ID)
+		}
+		for _, e := range item.Enclosures {
+			entry.Links = append(entry.Links, atomLink{Href: e.URL, Rel: "enclosure", Type: e.MimeType, Title: e.Filename, Length: e.Size})
+		}
+		atom.Entries = append(atom.Entries, entry)
+	}
+
+	writeXMLFeed(w, "application/atom+xml", atom)
+}
+
+func writeXMLFeed(w http.ResponseWriter, contentType string, feed any) {
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Write([]byte(xml.Header))
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		log.Printf("Failed to write feed: %v\n", err)
+	}
+}
+
+// JSON Feed 1.1, https://www.jsonfeed.org/version/1.1/
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Icon        string         `json:"icon,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title,omitempty"`
+	ContentHTML   string               `json:"content_html"`
+	DatePublished time.Time            `json:"date_published"`
+	DateModified  time.Time            `json:"date_modified"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	Title       string `json:"title,omitempty"`
+	SizeInBytes int64  `json:"size_in_bytes"`
+}
+
+func getJsonFeed(w http.ResponseWriter, r *http.Request) {
+	feed, err := buildFeed(r)
+	if err != nil {
+		log.Printf("Failed to build feed: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	jf := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feed.Title,
+		HomePageURL: feed.SiteURL,
+		FeedURL:     feed.SelfURL,
+		Description: feed.Description,
+		Icon:        feed.Logo,
+		Items:       []jsonFeedItem{},
+	}
+
+	for _, item := range feed.Items {
+		ji := jsonFeedItem{
+			ID:            strconv.Itoa(item.ID),
+			URL:           item.URL,
+			Title:         item.Title,
+			ContentHTML:   item.HTML,
+			DatePublished: item.Published,
+			DateModified:  item.Updated,
+		}
+		for _, e := range item.Enclosures {
+			ji.Attachments = append(ji.Attachments, jsonFeedAttachment{URL: e.URL, MimeType: e.MimeType, Title: e.Filename, SizeInBytes: e.Size})
+		}
+		jf.Items = append(jf.Items, ji)
+	}
+
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	json.NewEncoder(w).Encode(jf)
+}
+
+type FeedTokenResponse struct {
+	Token string `json:"token"`
+	Rss   string `json:"rss"`
+	Atom  string `json:"atom"`
+	Json  string `json:"json"`
+}
+
+// getFeedToken returns the feed addresses of the logged in user. The token is
+// only added to them when the channel requires auth.
+func getFeedToken(w http.ResponseWriter, r *http.Request) {
+	writeFeedToken(w, r, dbGetFeedToken)
+}
+
+func resetFeedToken(w http.ResponseWriter, r *http.Request) {
+	writeFeedToken(w, r, dbResetFeedToken)
+}
+
+func writeFeedToken(w http.ResponseWriter, r *http.Request, getToken func(context.Context, string) (string, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, _ := store.Get(r, cookieName)
+	user, _ := session.Values["user"].(Session)
+
+	token, err := getToken(ctx, user.Email)
+	if err != nil {
+		log.Printf("Failed to get feed token: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	query := ""
+	if settingConfig.RequireAuth {
+		query = "?token=" + url.QueryEscape(token)
+	}
+
+	base := projectURL()
+	response := FeedTokenResponse{
+		Token: token,
+		Rss:   base + "/feed.rss" + query,
+		Atom:  base + "/feed.atom" + query,
+		Json:  base + "/feed.json" + query,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
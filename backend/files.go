@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
@@ -30,8 +31,111 @@ type FileResponse struct {
 	FileType string `json:"filetype"`
 }
 
+func (f FileResponse) MarshalBinary() ([]byte, error) {
+	return json.Marshal(f)
+}
+
+// FileInfo describes an uploaded file, for listing it outside a message, such
+// as a feed enclosure.
+type FileInfo struct {
+	ID       string
+	Filename string
+	MimeType string
+	Size     int64
+}
+
 var maxBytesReader *http.MaxBytesError
 
+// getFileInfo returns nil when the file does not exist or was deleted.
+func getFileInfo(fileId string) (*FileInfo, error) {
+	if len(fileId) < 4 {
+		return nil, nil
+	}
+
+	metadataFile, err := os.ReadFile(filepath.Join(rootUploadPath, fileId[:2], fileId[2:4], fileId+".yaml"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var metaData map[string]any
+	if err := yaml.Unmarshal(metadataFile, &metaData); err != nil {
+		return nil, err
+	}
+
+	if delete, _ := metaData["delete"].(bool); delete {
+		return nil, nil
+	}
+
+	fileHash, _ := dyno.GetString(metaData["hash"])
+	if len(fileHash) < 4 {
+		return nil, nil
+	}
+
+	file, err := os.Open(filepath.Join(rootUploadPath, fileHash[:2], fileHash[2:4], fileHash))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &FileInfo{ID: fileId, Size: stat.Size()}
+	info.Filename, _ = dyno.GetString(metaData["filename"])
+
+	// The metadata only keeps the top level type ("image"), the full MIME
+	// type is detected again from the content.
+	head := make([]byte, 512)
+	n, _ := file.Read(head)
+	if t, _ := filetype.Match(head[:n]); t != filetype.Unknown {
+		info.MimeType = t.MIME.Value
+	} else if t := mime.TypeByExtension(filepath.Ext(info.Filename)); t != "" {
+		info.MimeType = t
+	} else {
+		info.MimeType = "application/octet-stream"
+	}
+
+	return info, nil
+}
+
+// markFileDeleted sets delete in the file metadata, so the file is no longer
+// served. The stored content is kept, other uploads may share it.
+func markFileDeleted(fileId string) error {
+	if len(fileId) < 4 {
+		return nil
+	}
+
+	metadataFilePath := filepath.Join(rootUploadPath, fileId[:2], fileId[2:4], fileId+".yaml")
+	metadataFile, err := os.ReadFile(metadataFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var metaData map[string]any
+	if err := yaml.Unmarshal(metadataFile, &metaData); err != nil {
+		return err
+	}
+	metaData["delete"] = true
+
+	yamlData, err := yaml.Marshal(metaData)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(metadataFilePath, yamlData, 0644)
+}
+
 func serveFile(w http.ResponseWriter, r *http.Request) {
 	fileId := chi.URLParam(r, "fileid")
 
@@ -75,11 +179,23 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	if err := os.MkdirAll(rootUploadPath, os.ModePerm); err != nil {
+	fileResponse, err := saveFile(file, handler.Filename)
+	if err != nil {
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileResponse)
+}
+
+// saveFile stores the content once under its SHA-256 hash and writes a YAML
+// metadata file under a new random ID, which is what the file URL points to.
+func saveFile(file io.ReadSeeker, filename string) (FileResponse, error) {
+	if err := os.MkdirAll(rootUploadPath, os.ModePerm); err != nil {
+		return FileResponse{}, err
+	}
+
 	head := make([]byte, 512)
 	file.Read(head)
 
@@ -88,14 +204,12 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	file.Seek(0, io.SeekStart)
 	fileHash, err := generatedFileHash(file)
 	if err != nil {
-		http.Error(w, "error", http.StatusInternalServerError)
-		return
+		return FileResponse{}, err
 	}
 
 	hashSubDir := filepath.Join(rootUploadPath, fileHash[:2], fileHash[2:4])
 	if err := os.MkdirAll(hashSubDir, os.ModePerm); err != nil {
-		http.Error(w, "error", http.StatusInternalServerError)
-		return
+		return FileResponse{}, err
 	}
 
 	var isDuplicateFile bool
@@ -111,30 +225,26 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 		file.Seek(0, io.SeekStart)
 		destFile, err := os.Create(destPath)
 		if err != nil {
-			http.Error(w, "error", http.StatusInternalServerError)
-			return
+			return FileResponse{}, err
 		}
 		defer destFile.Close()
 
 		if _, err := io.Copy(destFile, file); err != nil {
-			http.Error(w, "error", http.StatusInternalServerError)
-			return
+			return FileResponse{}, err
 		}
 	}
 
 	id := generatedRandomID(20)
 	if id == "" {
-		http.Error(w, "error", http.StatusInternalServerError)
-		return
+		return FileResponse{}, errors.New("failed to generate file id")
 	}
 
 	yamlFileDir := filepath.Join(rootUploadPath, id[:2], id[2:4])
 	if err := os.MkdirAll(yamlFileDir, os.ModePerm); err != nil {
-		http.Error(w, "error", http.StatusInternalServerError)
-		return
+		return FileResponse{}, err
 	}
 
-	safeFilename := gozaru.Sanitize(handler.Filename)
+	safeFilename := gozaru.Sanitize(filename)
 
 	fileMetadata := map[string]any{
 		"id":       id,
@@ -146,26 +256,23 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	metadataFilePath := filepath.Join(rootUploadPath, id[:2], id[2:4], id+".yaml")
 	metadataFile, err := os.Create(metadataFilePath)
 	if err != nil {
-		http.Error(w, "error", http.StatusInternalServerError)
-		return
+		return FileResponse{}, err
 	}
 	defer metadataFile.Close()
 
 	yamlData, err := yaml.Marshal(fileMetadata)
 	if err != nil {
-		http.Error(w, "error", http.StatusInternalServerError)
-		return
+		return FileResponse{}, err
 	}
 	metadataFile.Write(yamlData)
 
 	fileUrl := "/api/files/" + id
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(FileResponse{
+	return FileResponse{
 		URL:      fileUrl,
-		Filename: handler.Filename,
+		Filename: filename,
 		FileType: t.MIME.Type,
-	})
+	}, nil
 }
 
 func generatedFileHash(file io.Reader) (string, error) {
@@ -38,9 +38,25 @@ func ifRequireAuth(next http.Handler) http.Handler {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import-telegram":
+			runTelegramImportCommand(os.Args[2:])
+			return
+		case "restore":
+			runRestoreCommand(os.Args[2:])
+			return
+		}
+	}
+
 	gob.Register(Session{})
 	initializePrivilegeUsers()
 	go statLogger()
+	go reindexSearch()
+	go indexDeletedMessages()
+	go eventHub.Run()
+	go webhookWorker()
+	go activityPubWorker()
 
 	var err error
 	store, err = redistore.NewRediStore(10, redisType, redisAddr, "", redisPass, []byte(secretKey))
@@ -55,18 +71,48 @@ func main() {
 	r.Use(middleware.Logger)
 
 	// Protected with api key
-	r.Post("/api/import/post", addNewPost)
+	r.Post("/api/import/post", protectedWithApiKey(ScopePost, addNewPost))
+	r.Post("/api/import/bulk", protectedWithApiKey(ScopePost, bulkImport))
+	r.Post("/api/import/telegram", protectedWithApiKey(ScopePost, importTelegram))
+	r.Get("/api/import/messages/{id}", protectedWithApiKey(ScopeRead, getApiMessage))
+	r.Get("/api/import/external/{externalId}", protectedWithApiKey(ScopeRead, getMessageIdByExternalId))
+	r.Post("/api/import/edit-message", protectedWithApiKey(ScopeEdit, updateApiMessage))
+	r.Post("/api/import/delete-message/{id}", protectedWithApiKey(ScopeDelete, deleteApiMessage))
+	r.Post("/api/import/upload", protectedWithApiKey(ScopeUpload, uploadApiFile))
 
 	r.Get("/auth/google", getGoogleAuthValues)
 	r.Post("/auth/login", login)
 	r.Post("/auth/logout", logout)
 	r.Get("/assets/favicon.ico", getFavicon)
 	r.Get("/favicon.ico", getFavicon)
+	r.Get("/sitemap.xml", getSitemap)
+	r.Get("/robots.txt", getRobots)
 
 	r.Group(func(r chi.Router) {
 		r.Use(checkLogin)
 		r.Post("/api/reactions/set-reactions", setReactions)
 		r.Post("/api/messages/report", reportMessage)
+		r.Get("/api/feed-token", getFeedToken)
+		r.Post("/api/feed-token/reset", resetFeedToken)
+	})
+
+	// Feed readers cannot log in, so these also accept a user's feed token.
+	r.Group(func(r chi.Router) {
+		r.Use(ifRequireAuthOrFeedToken)
+		r.Get("/feed.rss", getRssFeed)
+		r.Get("/feed.atom", getAtomFeed)
+		r.Get("/feed.json", getJsonFeed)
+		r.Get("/api/feed/files/{fileid}", serveFeedFile)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(ifActivityPubEnabled)
+		r.Get("/.well-known/webfinger", getWebFinger)
+		r.Get("/activitypub/actor", getActivityPubActor)
+		r.Get("/activitypub/outbox", getActivityPubOutbox)
+		r.Get("/activitypub/followers", getActivityPubFollowers)
+		r.Get("/activitypub/messages/{id}", getActivityPubNote)
+		r.Post("/activitypub/inbox", postActivityPubInbox)
 	})
 
 	r.Group(func(r chi.Router) {
@@ -80,21 +126,37 @@ func main() {
 
 			api.Get("/channel/info", getChannelInfo)
 			api.Get("/messages", getMessages)
+			api.Get("/messages/search", searchMessages)
+			api.Get("/messages/pinned", getPinnedMessages)
+			api.Get("/messages/{id}/replies", getReplies)
 			api.Get("/events", getEvents)
+			api.Get("/ws", getWsEvents)
 			api.Get("/files/{fileid}", serveFile)
 			api.Get("/user-info", getUserInfo)
 
 			api.Route("/admin", func(protected chi.Router) {
 				// ⚠️ WARNING: Route not check privilege use protectedWithPrivilege to check privilege.
 
+				// Writers manage the content of messages, including undoing a
+				// delete or an edit from the trash and the edit history.
 				protected.Post("/new", protectedWithPrivilege(Writer, addMessage))
 				protected.Post("/edit-message", protectedWithPrivilege(Writer, updateMessage))
 				protected.Get("/delete-message/{id}", protectedWithPrivilege(Writer, deleteMessage))
+				protected.Get("/messages/deleted", protectedWithPrivilege(Writer, getDeletedMessages))
+				protected.Post("/messages/{id}/restore", protectedWithPrivilege(Writer, restoreDeletedMessage))
+				protected.Get("/messages/{id}/revisions", protectedWithPrivilege(Writer, getMessageRevisions))
+				protected.Post("/messages/{id}/revisions/{revision}/restore", protectedWithPrivilege(Writer, restoreMessageRevision))
 				protected.Post("/upload", protectedWithPrivilege(Writer, uploadFile))
 				protected.Get("/scheduled-messages/get", protectedWithPrivilege(Writer, getScheduledMessages))
 				protected.Post("/scheduled-messages/update", protectedWithPrivilege(Writer, updateScheduledMessages))
 
+				// Moderators make changes that apply to the whole channel, like
+				// the pinned messages shown above it, or that cannot be undone,
+				// like purging a deleted message.
 				protected.Post("/edit-channel-info", protectedWithPrivilege(Moderator, editChannelInfo))
+				protected.Post("/messages/{id}/pin", protectedWithPrivilege(Moderator, pinMessage))
+				protected.Post("/messages/{id}/unpin", protectedWithPrivilege(Moderator, unpinMessage))
+				protected.Post("/messages/{id}/purge", protectedWithPrivilege(Moderator, purgeDeletedMessage))
 				protected.Get("/statistics", protectedWithPrivilege(Moderator, getStatistics))
 				protected.Post("/set-emojis", protectedWithPrivilege(Moderator, setEmojis))
 
@@ -105,12 +167,24 @@ func main() {
 				protected.Post("/settings/set", protectedWithPrivilege(Admin, setSettings))
 				protected.Get("/reports/get", protectedWithPrivilege(Admin, getReports))
 				protected.Post("/reports/set", protectedWithPrivilege(Admin, setReports))
+				protected.Get("/webhooks/get", protectedWithPrivilege(Admin, getWebhooksList))
+				protected.Post("/webhooks/set", protectedWithPrivilege(Admin, setWebhook))
+				protected.Post("/webhooks/delete/{id}", protectedWithPrivilege(Admin, deleteWebhook))
+				protected.Get("/webhooks/deliveries", protectedWithPrivilege(Admin, getWebhookDeliveries))
+				protected.Get("/webhooks/deliveries/{id}", protectedWithPrivilege(Admin, getWebhookDelivery))
+				protected.Post("/webhooks/deliveries/{id}/redeliver", protectedWithPrivilege(Admin, redeliverWebhook))
+				protected.Get("/api-keys/get", protectedWithPrivilege(Admin, getApiKeysList))
+				protected.Post("/api-keys/create", protectedWithPrivilege(Admin, createApiKey))
+				protected.Post("/api-keys/revoke/{id}", protectedWithPrivilege(Admin, revokeApiKey))
+				protected.Get("/export", protectedWithPrivilege(Admin, exportChannel))
+				protected.Get("/activitypub/followers", protectedWithPrivilege(Admin, getActivityPubFollowersList))
 			})
 		})
 	})
 
 	if settingConfig.RootStaticFolder != "" {
 		r.Handle("/assets/*", http.StripPrefix("/assets/", http.FileServer(http.Dir(settingConfig.RootStaticFolder))))
+		r.Get("/message/{id}", serveSpaFile)
 		r.NotFound(serveSpaFile)
 	}
 
@@ -131,8 +205,16 @@ func serveSpaFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	meta, ok := pageMeta(r)
+
 	if settingConfig.CustomTitle != "" {
 		content = bytes.ReplaceAll(content, []byte("<title></title>"), []byte(settingConfig.CustomTitle))
+	} else if ok {
+		content = bytes.ReplaceAll(content, []byte("<title></title>"), []byte(meta.TitleTag()))
+	}
+
+	if ok {
+		content = bytes.Replace(content, []byte("</head>"), []byte(meta.Tags()+"</head>"), 1)
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
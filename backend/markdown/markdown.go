@@ -0,0 +1,306 @@
+// Package markdown renders message text to HTML for places outside the web
+// client, such as feeds and link previews.
+//
+// It covers the markdown the client writes (paragraphs, emphasis, code, links,
+// quotes, lists, headings) and its custom embeds like
+// "[image-embedded#](url)". All text is escaped and only http, https, mailto
+// and site relative URLs are kept, so the output is safe to embed as is.
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	embedPattern    = regexp.MustCompile(`\[(video|audio|image|quote)-embedded#\]\(([^)]*)\)`)
+	linkPattern     = regexp.MustCompile(`!?\[([^\]]*)\]\(([^)\s]+)\)`)
+	autolinkPattern = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+	codePattern     = regexp.MustCompile("`([^`\n]+)`")
+	escapePattern   = regexp.MustCompile("\\\\([\\\\`*_{}\\[\\]()#+\\-.!|~<>])")
+
+	headingPattern     = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	bulletPattern      = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+	orderedPattern     = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+	placeholderPattern = regexp.MustCompile("\x00(\\d+)\x00")
+
+	strongPattern    = regexp.MustCompile(`\*\*([^*\n]+?)\*\*`)
+	strongAltPattern = regexp.MustCompile(`__([^_\n]+?)__`)
+	emPattern        = regexp.MustCompile(`\*([^*\s][^*\n]*?)\*`)
+	emAltPattern     = regexp.MustCompile(`(^|[\s(>])_([^_\n]+?)_`)
+	strikePattern    = regexp.MustCompile(`~~([^~\n]+?)~~`)
+	underlinePattern = regexp.MustCompile(`&lt;u&gt;(.+?)&lt;/u&gt;`)
+)
+
+// Renderer converts markdown to HTML.
+type Renderer struct {
+	// ResolveURL, when set, rewrites every link and media URL that passed the
+	// safety check, for example to make site relative URLs absolute.
+	ResolveURL func(u string) string
+}
+
+// ToHTML renders the markdown source as an HTML fragment.
+func (r *Renderer) ToHTML(src string) string {
+	src = strings.ReplaceAll(src, "\x00", "")
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+
+	var b strings.Builder
+	r.renderBlocks(&b, strings.Split(src, "\n"))
+
+	return strings.TrimSpace(b.String())
+}
+
+func (r *Renderer) renderBlocks(b *strings.Builder, lines []string) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		rendered := make([]string, len(paragraph))
+		for i, line := range paragraph {
+			rendered[i] = r.inline(strings.TrimSpace(line))
+		}
+		b.WriteString("<p>" + strings.Join(rendered, "<br>\n") + "</p>\n")
+		paragraph = nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+
+		switch {
+		case trimmed == "":
+			flush()
+
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				line := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(line, " "))
+			}
+			i--
+			b.WriteString("<blockquote>\n")
+			r.renderBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+
+		case headingPattern.MatchString(trimmed):
+			flush()
+			match := headingPattern.FindStringSubmatch(trimmed)
+			level := len(match[1])
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", level, r.inline(match[2]), level)
+
+		case bulletPattern.MatchString(trimmed), orderedPattern.MatchString(trimmed):
+			flush()
+			pattern, tag := bulletPattern, "ul"
+			if !bulletPattern.MatchString(trimmed) {
+				pattern, tag = orderedPattern, "ol"
+			}
+			b.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && pattern.MatchString(strings.TrimSpace(lines[i])); i++ {
+				item := pattern.FindStringSubmatch(strings.TrimSpace(lines[i]))[1]
+				b.WriteString("<li>" + r.inline(item) + "</li>\n")
+			}
+			i--
+			b.WriteString("</" + tag + ">\n")
+
+		default:
+			paragraph = append(paragraph, lines[i])
+		}
+	}
+	flush()
+}
+
+// inline renders the formatting within one line. Code, escapes, embeds and
+// links are cut out into placeholders first, so emphasis is not applied
+// inside them and their URLs are never seen by the other patterns.
+func (r *Renderer) inline(text string) string {
+	var parts []string
+	hold := func(rendered string) string {
+		parts = append(parts, rendered)
+		return fmt.Sprintf("\x00%d\x00", len(parts)-1)
+	}
+
+	text = codePattern.ReplaceAllStringFunc(text, func(s string) string {
+		return hold("<code>" + html.EscapeString(codePattern.FindStringSubmatch(s)[1]) + "</code>")
+	})
+	text = escapePattern.ReplaceAllStringFunc(text, func(s string) string {
+		return hold(html.EscapeString(s[1:]))
+	})
+	text = embedPattern.ReplaceAllStringFunc(text, func(s string) string {
+		match := embedPattern.FindStringSubmatch(s)
+		return hold(r.embed(match[1], match[2]))
+	})
+	text = linkPattern.ReplaceAllStringFunc(text, func(s string) string {
+		match := linkPattern.FindStringSubmatch(s)
+		label := emphasis(html.EscapeString(match[1]))
+		href, ok := r.url(match[2])
+		if !ok {
+			return hold(label)
+		}
+		if strings.HasPrefix(s, "!") {
+			return hold(`<img src="` + html.EscapeString(href) + `" alt="` + html.EscapeString(match[1]) + `">`)
+		}
+		if label == "" {
+			label = html.EscapeString(href)
+		}
+		return hold(`<a href="` + html.EscapeString(href) + `">` + label + `</a>`)
+	})
+	text = autolinkPattern.ReplaceAllStringFunc(text, func(s string) string {
+		href, ok := r.url(s)
+		if !ok {
+			return hold(html.EscapeString(s))
+		}
+		return hold(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(s) + `</a>`)
+	})
+
+	text = emphasis(html.EscapeString(text))
+
+	// Placeholders can hold other placeholders, such as a link label with
+	// code in it, so they are expanded until none is left.
+	for placeholderPattern.MatchString(text) {
+		text = placeholderPattern.ReplaceAllStringFunc(text, func(s string) string {
+			var i int
+			fmt.Sscanf(placeholderPattern.FindStringSubmatch(s)[1], "%d", &i)
+			return parts[i]
+		})
+	}
+
+	return text
+}
+
+func emphasis(text string) string {
+	text = strongPattern.ReplaceAllString(text, "<strong>$1</strong>")
+	text = strongAltPattern.ReplaceAllString(text, "<strong>$1</strong>")
+	text = emPattern.ReplaceAllString(text, "<em>$1</em>")
+	text = emAltPattern.ReplaceAllString(text, "$1<em>$2</em>")
+	text = strikePattern.ReplaceAllString(text, "<del>$1</del>")
+	text = underlinePattern.ReplaceAllString(text, "<u>$1</u>")
+
+	return text
+}
+
+func (r *Renderer) embed(kind, target string) string {
+	if kind == "quote" {
+		// "<message id>@<quoted text>"
+		_, quoted, _ := strings.Cut(target, "@")
+		return "<blockquote>" + html.EscapeString(quoted) + "</blockquote>"
+	}
+
+	src, ok := r.url(target)
+	if !ok {
+		return ""
+	}
+	src = html.EscapeString(src)
+
+	switch kind {
+	case "image":
+		return `<img src="` + src + `" alt="">`
+	case "video":
+		return `<video controls src="` + src + `"><a href="` + src + `">` + src + `</a></video>`
+	default:
+		return `<audio controls src="` + src + `"><a href="` + src + `">` + src + `</a></audio>`
+	}
+}
+
+// url reports whether the URL is safe to link to, and returns it resolved.
+func (r *Renderer) url(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+	case "":
+		// browsers read "/\\host" as "//host", another site
+		if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") || strings.HasPrefix(raw, "/\\") {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+
+	if r.ResolveURL != nil {
+		raw = r.ResolveURL(raw)
+	}
+
+	return raw, true
+}
+
+// ToText strips the markdown down to plain text, dropping media embeds and
+// keeping the label of links.
+func ToText(src string) string {
+	src = strings.ReplaceAll(src, "\x00", "")
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+
+	// Escaped characters are held aside so they are not taken as formatting.
+	var escaped []string
+	src = escapePattern.ReplaceAllStringFunc(src, func(s string) string {
+		escaped = append(escaped, s[1:])
+		return fmt.Sprintf("\x00%d\x00", len(escaped)-1)
+	})
+
+	src = embedPattern.ReplaceAllString(src, "")
+	src = linkPattern.ReplaceAllString(src, "$1")
+	src = codePattern.ReplaceAllString(src, "$1")
+
+	lines := strings.Split(src, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "```") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimLeft(line, ">"))
+		if match := headingPattern.FindStringSubmatch(line); match != nil {
+			line = match[2]
+		} else if match := bulletPattern.FindStringSubmatch(line); match != nil {
+			line = match[1]
+		}
+		kept = append(kept, line)
+	}
+	src = strings.Join(kept, "\n")
+
+	src = strongPattern.ReplaceAllString(src, "$1")
+	src = strongAltPattern.ReplaceAllString(src, "$1")
+	src = emPattern.ReplaceAllString(src, "$1")
+	src = emAltPattern.ReplaceAllString(src, "$1$2")
+	src = strikePattern.ReplaceAllString(src, "$1")
+	src = strings.NewReplacer("<u>", "", "</u>", "").Replace(src)
+	src = placeholderPattern.ReplaceAllStringFunc(src, func(s string) string {
+		var i int
+		fmt.Sscanf(placeholderPattern.FindStringSubmatch(s)[1], "%d", &i)
+		return escaped[i]
+	})
+
+	return strings.TrimSpace(src)
+}
+
+// Excerpt returns the plain text of the source collapsed to one line and cut
+// to at most max characters.
+func Excerpt(src string, max int) string {
+	text := strings.Join(strings.Fields(ToText(src)), " ")
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+
+	runes := []rune(text)
+	cut := strings.TrimSpace(string(runes[:max-1]))
+	if i := strings.LastIndex(cut, " "); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+
+	return cut + "…"
+}
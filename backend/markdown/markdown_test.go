@@ -0,0 +1,166 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestToHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "emphasis and escapes",
+			src:  `**bold** _em_ ~~gone~~ \*not em\*`,
+			want: `<p><strong>bold</strong> <em>em</em> <del>gone</del> *not em*</p>`,
+		},
+		{
+			name: "html is escaped",
+			src:  `<script>alert(1)</script> & "x"`,
+			want: `<p>&lt;script&gt;alert(1)&lt;/script&gt; &amp; &#34;x&#34;</p>`,
+		},
+		{
+			name: "links",
+			src:  `[site](https://example.com/a?b=1&c=2) [page](/about) [mail](mailto:a@example.com)`,
+			want: `<p><a href="https://example.com/a?b=1&amp;c=2">site</a> <a href="/about">page</a> <a href="mailto:a@example.com">mail</a></p>`,
+		},
+		{
+			name: "javascript links keep only the label",
+			src:  `[click](javascript:alert(1)) [x](JavaScript:alert%281%29)`,
+			want: `<p>click) x</p>`,
+		},
+		{
+			name: "data links keep only the label",
+			src:  `[x](data:text/html;base64,PHNjcmlwdD4=)`,
+			want: `<p>x</p>`,
+		},
+		{
+			name: "protocol relative links keep only the label",
+			src:  `[x](//evil.example/a) [y](/\evil.example)`,
+			want: `<p>x y</p>`,
+		},
+		{
+			name: "quotes and angle brackets in labels",
+			src:  `[a "b" <c>](https://example.com)`,
+			want: `<p><a href="https://example.com">a &#34;b&#34; &lt;c&gt;</a></p>`,
+		},
+		{
+			name: "quotes and angle brackets in urls",
+			src:  `[a](https://example.com/"onmouseover="x"<b>)`,
+			want: `<p><a href="https://example.com/&#34;onmouseover=&#34;x&#34;&lt;b&gt;">a</a></p>`,
+		},
+		{
+			name: "image alt is escaped",
+			src:  `![a "b" <c>](/api/files/1)`,
+			want: `<p><img src="/api/files/1" alt="a &#34;b&#34; &lt;c&gt;"></p>`,
+		},
+		{
+			name: "autolinks",
+			src:  `see https://example.com/a_b_c, and javascript:alert(1)`,
+			want: `<p>see <a href="https://example.com/a_b_c,">https://example.com/a_b_c,</a> and javascript:alert(1)</p>`,
+		},
+		{
+			name: "code inside a link label",
+			src:  "[run `a*b*c`](https://example.com)",
+			want: `<p><a href="https://example.com">run <code>a*b*c</code></a></p>`,
+		},
+		{
+			name: "link inside code is not rendered",
+			src:  "`[x](https://example.com)`",
+			want: `<p><code>[x](https://example.com)</code></p>`,
+		},
+		{
+			name: "literal placeholders in the input",
+			src:  "a\x000\x00b `c` \x001\x00",
+			want: `<p>a0b <code>c</code> 1</p>`,
+		},
+		{
+			name: "embeds",
+			src:  "[image-embedded#](/api/files/1)\n\n[video-embedded#](https://cdn.example/v.mp4)",
+			want: "<p><img src=\"/api/files/1\" alt=\"\"></p>\n<p><video controls src=\"https://cdn.example/v.mp4\"><a href=\"https://cdn.example/v.mp4\">https://cdn.example/v.mp4</a></video></p>",
+		},
+		{
+			name: "unsafe embeds are dropped",
+			src:  `[image-embedded#](javascript:alert(1)) [audio-embedded#](data:audio/mp3,x) [video-embedded#](//evil.example/v)`,
+			want: `<p>)  </p>`,
+		},
+		{
+			name: "quote embeds",
+			src:  `[quote-embedded#](12@<b>said</b>)`,
+			want: `<p><blockquote>&lt;b&gt;said&lt;/b&gt;</blockquote></p>`,
+		},
+		{
+			name: "blocks",
+			src:  "# Title\n\n> quoted\n> more\n\n- one\n- two\n\n```\n<x>\n```",
+			want: "<h1>Title</h1>\n<blockquote>\n<p>quoted<br>\nmore</p>\n</blockquote>\n<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n<pre><code>&lt;x&gt;</code></pre>",
+		},
+	}
+	r := &Renderer{}
+	for _, tt := range tests {
+		if got := r.ToHTML(tt.src); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestToHTMLResolveURL(t *testing.T) {
+	r := &Renderer{ResolveURL: func(u string) string {
+		if strings.HasPrefix(u, "/") {
+			return "https://channel.example" + u
+		}
+		return u
+	}}
+
+	got := r.ToHTML(`[a](/about) [b](javascript:x) [image-embedded#](/api/files/1)`)
+	want := `<p><a href="https://channel.example/about">a</a> b <img src="https://channel.example/api/files/1" alt=""></p>`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestToText(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"formatting", "# **Bold** _title_\n> quoted ~~x~~\n- item <u>under</u>", "Bold title\nquoted x\nitem under"},
+		{"links keep the label", "[site](https://example.com) and `code`", "site and code"},
+		{"embeds are dropped", "look [image-embedded#](/api/files/1) here", "look  here"},
+		{"escapes", `\*not em\* \[x\]`, "*not em* [x]"},
+		{"literal placeholders", "a\x000\x00b \\*", "a0b *"},
+		{"hebrew", "**שָׁלוֹם** עולם", "שָׁלוֹם עולם"},
+	}
+	for _, tt := range tests {
+		if got := ToText(tt.src); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		max  int
+		want string
+	}{
+		{"short text is kept", "**hello**\nworld", 20, "hello world"},
+		{"cut at a word", "one two three four", 12, "one two…"},
+		{"hebrew is cut by characters", "שלום עולם ומלואו", 11, "שלום עולם…"},
+		{"emoji are not split", "😀😀😀😀😀😀", 4, "😀😀😀…"},
+		{"a long word is cut inside", "abcdefghij", 5, "abcd…"},
+	}
+	for _, tt := range tests {
+		got := Excerpt(tt.src, tt.max)
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if !utf8.ValidString(got) || utf8.RuneCountInString(got) > tt.max {
+			t.Errorf("%s: %q is not valid text of at most %d characters", tt.name, got, tt.max)
+		}
+	}
+}
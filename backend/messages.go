@@ -3,44 +3,128 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 )
 
+// parsePageDate accepts a full RFC 3339 time or a date, which starts at
+// midnight UTC.
+func parsePageDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.DateOnly, value)
+}
+
+// getMessages returns a page of the timeline, newest message first. The page
+// is chosen by one of before, after or around (a message id) or date, and is
+// the latest messages without them; after=0 is the oldest messages. The older
+// offset and direction parameters are still accepted and answer with a plain
+// list of messages.
 func getMessages(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	offsetFromClient := r.URL.Query().Get("offset")
-	limitFromClient := r.URL.Query().Get("limit")
-	direction := r.URL.Query().Get("direction")
+	query := r.URL.Query()
 
-	offset, err := strconv.Atoi(offsetFromClient)
-	if err != nil {
-		offset = 0
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
 	}
 
-	limit, err := strconv.Atoi(limitFromClient)
-	if err != nil {
-		limit = 20
+	mode := pageLatest
+	cursor := 0
+	var date time.Time
+	legacy := query.Has("offset") || query.Has("direction")
+
+	for _, m := range []string{pageBefore, pageAfter, pageAround} {
+		if value := query.Get(m); value != "" {
+			if cursor, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "invalid message id", http.StatusBadRequest)
+				return
+			}
+			mode = m
+			legacy = false
+			break
+		}
 	}
 
-	messages, err := funcGetMessageRange(ctx, int64(offset), int64(limit), checkPrivilege(r, Writer), settingConfig.CountViews, direction)
+	if value := query.Get(pageDate); value != "" && mode == pageLatest {
+		if date, err = parsePageDate(value); err != nil {
+			http.Error(w, "invalid date", http.StatusBadRequest)
+			return
+		}
+		mode = pageDate
+		legacy = false
+	}
+
+	if legacy {
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		if query.Get("direction") == "asc" {
+			// offset 0 is the start of the timeline, as after 0 is
+			cursor = max(offset, 0)
+			mode = pageAfter
+		} else if offset > 0 {
+			cursor = offset
+			mode = pageBefore
+		}
+	}
+
+	isAdmin := checkPrivilege(r, Writer)
+
+	page, err := dbGetMessagePage(ctx, mode, cursor, date, int64(limit), isAdmin, settingConfig.CountViews)
+	if errors.Is(err, errCursorNotFound) && legacy {
+		// older clients cannot recover from a 404 while scrolling, so an
+		// offset message that was purged continues from its closest neighbour
+		var nearest int
+		if nearest, err = dbGetNearestMessageId(ctx, cursor, mode == pageBefore); err == nil {
+			switch {
+			case nearest != 0:
+				cursor = nearest
+			case mode == pageBefore:
+				// nothing newer is left, every message is before the offset
+				mode = pageLatest
+			default:
+				cursor = 0
+			}
+			page, err = dbGetMessagePage(ctx, mode, cursor, date, int64(limit), isAdmin, settingConfig.CountViews)
+		}
+	}
 	if err != nil {
+		if errors.Is(err, errCursorNotFound) {
+			http.Error(w, "message not found", http.StatusNotFound)
+			return
+		}
 		log.Printf("Failed to get messages: %v\n", err)
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
 
+	attachReplyPreviews(ctx, page.Messages, isAdmin)
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	if legacy {
+		messages := page.Messages
+		if mode == pageAfter {
+			// older clients get asc pages oldest first
+			slices.Reverse(messages)
+		}
+		json.NewEncoder(w).Encode(messages)
+	} else {
+		json.NewEncoder(w).Encode(page)
+	}
 
-	addViewsToMessages(ctx, messages)
+	addViewsToMessages(ctx, page.Messages)
 }
 
 func addMessage(w http.ResponseWriter, r *http.Request) {
@@ -61,6 +145,11 @@ func addMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if ok, err := replyTargetExists(ctx, body.ReplyTo); err != nil || !ok {
+		http.Error(w, "reply target not found", http.StatusBadRequest)
+		return
+	}
+
 	message.ID = getMessageNextId(ctx)
 	message.Type = body.Type
 	message.Author = user.PublicName
@@ -70,6 +159,7 @@ func addMessage(w http.ResponseWriter, r *http.Request) {
 	message.File = body.File
 	message.Views = 0
 	message.IsAds = body.IsAds
+	message.ReplyTo = body.ReplyTo
 
 	if err = setMessage(ctx, &message, false); err != nil {
 		log.Printf("Failed to set new message: %v\n", err)
@@ -77,13 +167,37 @@ func addMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go SendWebhook(context.Background(), "create", &message)
+	go SendWebhook(context.Background(), WebhookCreate, &message)
 	go pushFcmMessage(&message)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(message)
 }
 
+// ifMatchVersion reads the message version from the If-Match header. It
+// returns nil when the header is missing or "*", so the edit is not checked.
+func ifMatchVersion(r *http.Request) (*int, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return nil, nil
+	}
+
+	value = strings.Trim(strings.TrimPrefix(value, "W/"), `"`)
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &version, nil
+}
+
+func messageETag(m *Message) string {
+	return fmt.Sprintf(`"%d"`, m.Version)
+}
+
+// updateMessage applies the editable fields of the request to the stored
+// message. Everything else, such as the author, timestamp, views and
+// reactions, is kept as stored.
 func updateMessage(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -98,16 +212,69 @@ func updateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body.LastEdit = time.Now()
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, "invalid If-Match header", http.StatusBadRequest)
+		return
+	}
 
-	if err := setMessage(ctx, &body, true); err != nil {
-		response := Response{Success: false}
-		json.NewEncoder(w).Encode(response)
+	if body.Type != "" && !slices.Contains(messageTypes, body.Type) {
+		http.Error(w, "invalid message type", http.StatusBadRequest)
+		return
+	}
+
+	message, err := dbGetMessage(ctx, body.ID, true, settingConfig.CountViews)
+	if err != nil {
+		log.Printf("Failed to get message: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
 
-	go SendWebhook(context.Background(), "update", &body)
+	if message == nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
 
+	if body.ReplyTo != message.ReplyTo {
+		if ok, err := replyTargetExists(ctx, body.ReplyTo); err != nil || !ok || body.ReplyTo == message.ID {
+			http.Error(w, "reply target not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	before := *message
+	if body.Type != "" {
+		message.Type = body.Type
+	}
+	message.Text = body.Text
+	message.File = body.File
+	message.IsAds = body.IsAds
+	message.ReplyTo = body.ReplyTo
+	// editing can restore a deleted message, deleting has its own route
+	message.Deleted = message.Deleted && body.Deleted
+	message.LastEdit = time.Now()
+
+	session, _ := store.Get(r, cookieName)
+	user, _ := session.Values["user"].(Session)
+	setMessageEditor(&before, message, user.ID, user.PublicName)
+
+	if err := editMessage(ctx, &before, message, ifVersion); err != nil {
+		switch {
+		case errors.Is(err, errMessageVersionConflict):
+			http.Error(w, "message was changed by another edit", http.StatusPreconditionFailed)
+		case errors.Is(err, errMessageNotFound):
+			http.Error(w, "message not found", http.StatusNotFound)
+		default:
+			log.Printf("Failed to update message %d: %v\n", message.ID, err)
+			response := Response{Success: false}
+			json.NewEncoder(w).Encode(response)
+		}
+		return
+	}
+
+	go SendWebhook(context.Background(), WebhookUpdate, message)
+
+	w.Header().Set("ETag", messageETag(message))
 	response := Response{Success: true}
 	json.NewEncoder(w).Encode(response)
 }
@@ -118,7 +285,24 @@ func deleteMessage(w http.ResponseWriter, r *http.Request) {
 
 	id := chi.URLParam(r, "id")
 
-	idInt, _ := strconv.Atoi(id)
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := dbGetMessage(ctx, idInt, true, false)
+	if err != nil {
+		log.Printf("Failed to get message: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	if existing == nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
 	message := Message{ID: idInt, Deleted: true}
 
 	if err := funcDeleteMessage(ctx, id); err != nil {
@@ -127,12 +311,17 @@ func deleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go SendWebhook(context.Background(), "delete", &message)
+	go SendWebhook(context.Background(), WebhookDelete, &message)
 
 	response := Response{Success: true}
 	json.NewEncoder(w).Encode(response)
 }
 
+func writeEvent(w io.Writer, event Event) error {
+	_, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", event.ID, event.Data)
+	return err
+}
+
 func getEvents(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -144,29 +333,37 @@ func getEvents(w http.ResponseWriter, r *http.Request) {
 	heartbeat := time.NewTicker(25 * time.Second)
 	defer heartbeat.Stop()
 
+	// Browsers send Last-Event-ID when EventSource reconnects by itself,
+	// the query parameter lets clients resume after a page reload.
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+
+	client, replay, lastEventId, err := subscribeEvents(clientCtx, lastEventId, checkPrivilege(r, Writer))
+	if err != nil {
+		http.Error(w, "Failed to subscribe to events", http.StatusInternalServerError)
+		return
+	}
+	defer eventHub.Unsubscribe(client)
+
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Accel-Buffering", "no")
 
-	_, err := fmt.Fprintf(w, "data: {\"type\": \"heartbeat\"}\n\n")
+	_, err = fmt.Fprintf(w, "data: {\"type\": \"heartbeat\"}\n\n")
 	if err != nil {
 		return
 	}
-	flusher.Flush()
 
-	go increaseCounterSSE()
-	defer decreaseCounterSSE()
-
-	pubsub := rdb.Subscribe(r.Context(), "events")
-	defer pubsub.Close()
-
-	if _, err := pubsub.Receive(clientCtx); err != nil {
-		http.Error(w, "Failed to subscribe to events", http.StatusInternalServerError)
-		return
+	for _, event := range replay {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
 	}
+	flusher.Flush()
 
-	ch := pubsub.Channel()
 	for {
 		select {
 		case <-clientCtx.Done():
@@ -179,14 +376,17 @@ func getEvents(w http.ResponseWriter, r *http.Request) {
 			}
 			flusher.Flush()
 
-		case msg, ok := <-ch:
+		case event, ok := <-client.Events:
 			if !ok {
 				return
 			}
-			_, err := fmt.Fprintf(w, "data: %s\n\n", msg.Payload)
-			if err != nil {
+			if !eventIdAfter(event.ID, lastEventId) {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
 				return
 			}
+			lastEventId = event.ID
 			flusher.Flush()
 		}
 	}
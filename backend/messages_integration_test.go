@@ -0,0 +1,265 @@
+//go:build integration
+
+// The integration tests need a Redis or Kvrocks server, which they empty:
+//
+//	REDIS_ADDR=127.0.0.1:6379 REDIS_PROTOCOL=tcp go test -tags integration .
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/boj/redistore"
+)
+
+func TestMain(m *testing.M) {
+	gob.Register(Session{})
+	var err error
+	store, err = redistore.NewRediStore(10, redisType, redisAddr, "", redisPass, []byte("test"))
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func resetDB(t *testing.T) context.Context {
+	t.Helper()
+	ctx := context.Background()
+	if err := rdb.FlushDB(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// storeTimeline stores messages 1 to count, an hour apart.
+func storeTimeline(t *testing.T, ctx context.Context, count int) {
+	t.Helper()
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for id := 1; id <= count; id++ {
+		m := Message{ID: id, Type: "md", Text: "message " + strconv.Itoa(id), Timestamp: start.Add(time.Duration(id) * time.Hour)}
+		if err := storeMessage(ctx, &m, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func messageIds(messages []Message) []int {
+	ids := []int{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+type pageCase struct {
+	name      string
+	mode      string
+	cursor    int
+	limit     int64
+	isAdmin   bool
+	ids       []int
+	hasBefore bool
+	hasAfter  bool
+	anchor    int
+	notFound  bool
+}
+
+func checkPages(t *testing.T, ctx context.Context, tests []pageCase) {
+	t.Helper()
+	for _, tt := range tests {
+		page, err := dbGetMessagePage(ctx, tt.mode, tt.cursor, time.Time{}, tt.limit, tt.isAdmin, false)
+		if tt.notFound {
+			if !errors.Is(err, errCursorNotFound) {
+				t.Errorf("%s: got %v, want %v", tt.name, err, errCursorNotFound)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ids := messageIds(page.Messages); !slices.Equal(ids, tt.ids) {
+			t.Errorf("%s: got messages %v, want %v", tt.name, ids, tt.ids)
+		}
+		if page.HasMoreBefore != tt.hasBefore || page.HasMoreAfter != tt.hasAfter {
+			t.Errorf("%s: got hasMoreBefore %v and hasMoreAfter %v, want %v and %v", tt.name, page.HasMoreBefore, page.HasMoreAfter, tt.hasBefore, tt.hasAfter)
+		}
+		if page.Anchor != tt.anchor {
+			t.Errorf("%s: got anchor %d, want %d", tt.name, page.Anchor, tt.anchor)
+		}
+	}
+}
+
+func TestMessagePageEmptyChannel(t *testing.T) {
+	ctx := resetDB(t)
+
+	checkPages(t, ctx, []pageCase{
+		{name: "latest", mode: pageLatest, limit: 5, ids: []int{}},
+		{name: "after 0", mode: pageAfter, limit: 5, ids: []int{}},
+		{name: "before a missing message", mode: pageBefore, cursor: 1, limit: 5, notFound: true},
+		{name: "around a missing message", mode: pageAround, cursor: 1, limit: 5, notFound: true},
+	})
+
+	page, err := dbGetMessagePage(ctx, pageDate, 0, time.Now(), 5, false, false)
+	if err != nil || len(page.Messages) != 0 {
+		t.Errorf("date: got %v, %v", page, err)
+	}
+}
+
+func TestMessagePageEnds(t *testing.T) {
+	ctx := resetDB(t)
+	storeTimeline(t, ctx, 10)
+
+	checkPages(t, ctx, []pageCase{
+		{name: "latest", mode: pageLatest, limit: 3, ids: []int{10, 9, 8}, hasBefore: true},
+		{name: "after 0", mode: pageAfter, limit: 3, ids: []int{3, 2, 1}, hasAfter: true},
+		{name: "after 0, whole channel", mode: pageAfter, limit: 10, ids: []int{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{name: "before the oldest", mode: pageBefore, cursor: 1, limit: 3, ids: []int{}, hasAfter: true},
+		{name: "after the newest", mode: pageAfter, cursor: 10, limit: 3, ids: []int{}, hasBefore: true},
+		{name: "before the newest", mode: pageBefore, cursor: 10, limit: 3, ids: []int{9, 8, 7}, hasBefore: true, hasAfter: true},
+		{name: "after the oldest", mode: pageAfter, cursor: 1, limit: 3, ids: []int{4, 3, 2}, hasBefore: true, hasAfter: true},
+		{name: "around the newest", mode: pageAround, cursor: 10, limit: 3, ids: []int{10, 9, 8}, hasBefore: true, anchor: 10},
+		{name: "around the oldest", mode: pageAround, cursor: 1, limit: 3, ids: []int{3, 2, 1}, hasAfter: true, anchor: 1},
+		{name: "missing cursor", mode: pageBefore, cursor: 11, limit: 3, notFound: true},
+	})
+}
+
+func TestMessagePageDeletedAnchor(t *testing.T) {
+	ctx := resetDB(t)
+	storeTimeline(t, ctx, 10)
+	if err := funcDeleteMessage(ctx, "5"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkPages(t, ctx, []pageCase{
+		{name: "around", mode: pageAround, cursor: 5, limit: 4, ids: []int{7, 6, 4, 3}, hasBefore: true, hasAfter: true},
+		{name: "around as admin", mode: pageAround, cursor: 5, limit: 3, isAdmin: true, ids: []int{6, 5, 4}, hasBefore: true, hasAfter: true, anchor: 5},
+		{name: "before", mode: pageBefore, cursor: 5, limit: 3, ids: []int{4, 3, 2}, hasBefore: true, hasAfter: true},
+		{name: "after", mode: pageAfter, cursor: 5, limit: 3, ids: []int{8, 7, 6}, hasBefore: true, hasAfter: true},
+		{name: "skipped in a page", mode: pageBefore, cursor: 7, limit: 3, ids: []int{6, 4, 3}, hasBefore: true, hasAfter: true},
+	})
+
+	// the last message before the cursor is deleted, so there is nothing
+	// more to show
+	if err := funcDeleteMessage(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	checkPages(t, ctx, []pageCase{
+		{name: "before, only deleted messages left", mode: pageBefore, cursor: 2, limit: 3, ids: []int{}, hasAfter: true},
+		{name: "after 0 skips deleted", mode: pageAfter, limit: 2, ids: []int{3, 2}, hasAfter: true},
+	})
+}
+
+type legacyCase struct {
+	query string
+	ids   []int
+}
+
+func checkLegacy(t *testing.T, tests []legacyCase) {
+	t.Helper()
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		getMessages(w, httptest.NewRequest("GET", "/api/messages?"+tt.query, nil))
+
+		var messages []Message
+		if err := json.Unmarshal(w.Body.Bytes(), &messages); err != nil {
+			t.Errorf("%s: %d %s", tt.query, w.Code, w.Body.String())
+			continue
+		}
+		if ids := messageIds(messages); !slices.Equal(ids, tt.ids) {
+			t.Errorf("%s: got %v, want %v", tt.query, ids, tt.ids)
+		}
+	}
+}
+
+func TestGetMessagesLegacy(t *testing.T) {
+	ctx := resetDB(t)
+	storeTimeline(t, ctx, 10)
+
+	checkLegacy(t, []legacyCase{
+		{"offset=0&limit=3", []int{10, 9, 8}},
+		{"offset=0&limit=3&direction=desc", []int{10, 9, 8}},
+		{"offset=0&limit=3&direction=asc", []int{1, 2, 3}},
+		{"direction=asc&limit=3", []int{1, 2, 3}},
+		{"offset=8&limit=3", []int{7, 6, 5}},
+		{"offset=3&limit=3&direction=asc", []int{4, 5, 6}},
+		{"offset=9&limit=3&direction=asc", []int{10}},
+	})
+}
+
+func TestGetMessagesLegacyPurgedOffset(t *testing.T) {
+	ctx := resetDB(t)
+	storeTimeline(t, ctx, 10)
+	rdb.Set(ctx, "message:next_id", 12, 0)
+	for _, id := range []int{1, 2, 5, 6, 10} {
+		if err := funcDeleteMessage(ctx, strconv.Itoa(id)); err != nil {
+			t.Fatal(err)
+		}
+		if err := purgeMessage(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// left: 3, 4, 7, 8, 9
+	checkLegacy(t, []legacyCase{
+		{"offset=6&limit=3", []int{4, 3}},
+		{"offset=5&limit=3&direction=asc", []int{7, 8, 9}},
+		{"offset=2&limit=3", []int{}},
+		{"offset=1&limit=3&direction=asc", []int{3, 4, 7}},
+		{"offset=10&limit=2", []int{9, 8}},
+		{"offset=11&limit=2", []int{9, 8}},
+		{"offset=10&limit=3&direction=asc", []int{}},
+		{"offset=40&limit=3&direction=asc", []int{}},
+	})
+
+	// the page API still tells the client the cursor is gone
+	checkPages(t, ctx, []pageCase{
+		{name: "before a purged message", mode: pageBefore, cursor: 6, limit: 3, notFound: true},
+	})
+}
+
+func TestSearchMessagesCursor(t *testing.T) {
+	ctx := resetDB(t)
+	storeTimeline(t, ctx, 5)
+	if err := funcDeleteMessage(ctx, "4"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		offset   int64
+		isAdmin  bool
+		ids      []int
+		notFound bool
+	}{
+		{name: "first page", ids: []int{5, 3}},
+		{name: "first page as admin", isAdmin: true, ids: []int{5, 4}},
+		{name: "next page", offset: 3, ids: []int{2, 1}},
+		{name: "after a deleted result", offset: 4, ids: []int{3, 2}},
+		{name: "missing cursor", offset: 9, notFound: true},
+	}
+	for _, tt := range tests {
+		messages, err := dbSearchMessages(ctx, []string{"message"}, tt.offset, 2, tt.isAdmin, false)
+		if tt.notFound {
+			if !errors.Is(err, errCursorNotFound) {
+				t.Errorf("%s: got %v, want %v", tt.name, err, errCursorNotFound)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ids := messageIds(messages); !slices.Equal(ids, tt.ids) {
+			t.Errorf("%s: got %v, want %v", tt.name, ids, tt.ids)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const maxPinnedMessages = 50
+
+type PinRequest struct {
+	// ExpiresAt unpins the message automatically, checked once a minute.
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+func getPinnedMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	isAdmin := checkPrivilege(r, Writer)
+
+	messages, err := dbGetPinnedMessages(ctx, isAdmin, settingConfig.CountViews)
+	if err != nil {
+		log.Printf("Failed to get pinned messages: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	attachReplyPreviews(ctx, messages, isAdmin)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+func pinMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	var body PinRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "error decoding request", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(now) {
+		http.Error(w, "expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	message, err := dbGetMessage(ctx, id, false, false)
+	if err != nil {
+		log.Printf("Failed to get message: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	if message == nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	if !message.Pinned {
+		count, err := dbCountPinnedMessages(ctx)
+		if err != nil {
+			log.Printf("Failed to count pinned messages: %v\n", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		if count >= maxPinnedMessages {
+			http.Error(w, "too many pinned messages", http.StatusConflict)
+			return
+		}
+	}
+
+	pinnedAt := now
+	if message.Pinned && message.PinnedAt != nil {
+		// changing the expiry keeps the message in its place
+		pinnedAt = *message.PinnedAt
+	}
+
+	if err := dbPinMessage(ctx, id, pinnedAt, body.ExpiresAt); err != nil {
+		log.Printf("Failed to pin message %d: %v\n", id, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	publishPinEvent(ctx, "pin", id)
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func unpinMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	unpinned, err := dbUnpinMessage(ctx, id)
+	if err != nil {
+		log.Printf("Failed to unpin message %d: %v\n", id, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	if !unpinned {
+		http.Error(w, "message is not pinned", http.StatusNotFound)
+		return
+	}
+
+	publishPinEvent(ctx, "unpin", id)
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// publishPinEvent sends the message with its new pin state, so clients can
+// update their pinned bar and the message itself.
+func publishPinEvent(ctx context.Context, pushType string, id int) {
+	message, err := dbGetMessage(ctx, id, true, false)
+	if err != nil || message == nil {
+		log.Printf("Failed to get message %d for %s event: %v\n", id, pushType, err)
+		return
+	}
+
+	publishEvent(ctx, &PushMessage{Type: pushType, M: *message})
+}
+
+// expirePinnedMessages unpins the messages whose pin expired. It runs on the
+// scheduled messages ticker.
+func expirePinnedMessages() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ids, err := dbGetExpiredPins(ctx, time.Now())
+	if err != nil {
+		log.Printf("Failed to get expired pins: %v\n", err)
+		return
+	}
+
+	for _, id := range ids {
+		unpinned, err := dbUnpinMessage(ctx, id)
+		if err != nil {
+			log.Printf("Failed to unpin message %d: %v\n", id, err)
+			continue
+		}
+		if unpinned {
+			publishPinEvent(ctx, "unpin", id)
+		}
+	}
+}
@@ -103,6 +103,14 @@ func setPrivilegeUsers(w http.ResponseWriter, r *http.Request) {
 
 	initializePrivilegeUsers()
 
+	session, _ := store.Get(r, cookieName)
+	user, _ := session.Values["user"].(Session)
+	go sendWebhookEvent(context.Background(), WebhookPayload{
+		Action:     WebhookPrivileges,
+		Privileges: &WebhookPrivilegesBody{Users: req.List},
+		Actor:      webhookUserFromSession(user),
+	})
+
 	response := Response{Success: true}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
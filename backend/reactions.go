@@ -54,11 +54,23 @@ func setReactions(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := setReaction(ctx, req.MessageID, req.Emoji, userId); err != nil {
+	reactions, removed, err := setReaction(ctx, req.MessageID, req.Emoji, userId)
+	if err != nil {
 		http.Error(w, "Failed to set reactions", http.StatusInternalServerError)
 		return
 	}
 
+	go sendWebhookEvent(context.Background(), WebhookPayload{
+		Action: WebhookReaction,
+		Reaction: &WebhookReactionBody{
+			MessageId: req.MessageID,
+			Emoji:     req.Emoji,
+			UserId:    userId,
+			Removed:   removed,
+			Reactions: reactions,
+		},
+	})
+
 	var response Response
 	response.Success = true
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"channel/markdown"
+)
+
+const replyPreviewLength = 100
+
+// ReplyPreview is the part of the original message shown above a reply. It
+// is resolved when the reply is read rather than stored with it, so it always
+// reflects the current text of the original.
+type ReplyPreview struct {
+	ID      int    `json:"id"`
+	Text    string `json:"text"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+func newReplyPreview(id int, text string, deleted, isAdmin bool) *ReplyPreview {
+	preview := &ReplyPreview{ID: id, Deleted: deleted}
+	if !deleted || isAdmin {
+		preview.Text = markdown.Excerpt(text, replyPreviewLength)
+	}
+
+	return preview
+}
+
+// attachReplyPreviews fills Reply for the messages that reply to another one.
+func attachReplyPreviews(ctx context.Context, messages []Message, isAdmin bool) {
+	var ids []int
+	for _, m := range messages {
+		if m.ReplyTo != 0 {
+			ids = append(ids, m.ReplyTo)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	previews, err := dbGetReplyPreviews(ctx, ids, isAdmin)
+	if err != nil {
+		log.Printf("Failed to get reply previews: %v\n", err)
+		return
+	}
+
+	for i := range messages {
+		messages[i].Reply = previews[messages[i].ReplyTo]
+	}
+}
+
+// replyTargetExists reports whether a new message may reply to id.
+func replyTargetExists(ctx context.Context, id int) (bool, error) {
+	if id == 0 {
+		return true, nil
+	}
+
+	m, err := dbGetMessage(ctx, id, false, false)
+	if err != nil {
+		return false, err
+	}
+
+	return m != nil, nil
+}
+
+func getReplies(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	isAdmin := checkPrivilege(r, Writer)
+
+	// replies stay visible after the original is deleted
+	original, err := dbGetMessage(ctx, id, true, false)
+	if err != nil {
+		log.Printf("Failed to get message: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	if original == nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	messages, err := dbGetReplies(ctx, id, int64(offset), int64(limit), isAdmin, settingConfig.CountViews)
+	if err != nil {
+		log.Printf("Failed to get replies: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	attachReplyPreviews(ctx, messages, isAdmin)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+
+	addViewsToMessages(ctx, messages)
+}
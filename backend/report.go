@@ -62,6 +62,11 @@ func reportMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	go sendWebhookEvent(context.Background(), WebhookPayload{
+		Action: WebhookReport,
+		Report: &report,
+	})
+
 	var response Response
 	response.Success = true
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// MessageRevision is the content a message had before one of its edits,
+// with who wrote that content and when.
+type MessageRevision struct {
+	Revision int          `json:"revision"`
+	Type     string       `json:"type"`
+	Text     string       `json:"text"`
+	File     FileResponse `json:"file"`
+	IsAds    bool         `json:"is_ads"`
+	EditorId string       `json:"editorId"`
+	Editor   string       `json:"editor"`
+	EditedAt time.Time    `json:"editedAt"`
+}
+
+func messageRevision(m *Message) *MessageRevision {
+	rev := &MessageRevision{
+		Type:     m.Type,
+		Text:     m.Text,
+		File:     m.File,
+		IsAds:    m.IsAds,
+		EditorId: m.AuthorId,
+		Editor:   m.Author,
+		EditedAt: m.Timestamp,
+	}
+	if m.LastEditorId != "" {
+		rev.EditorId = m.LastEditorId
+		rev.Editor = m.LastEditor
+	}
+	if m.LastEdit.After(m.Timestamp) {
+		rev.EditedAt = m.LastEdit
+	}
+
+	return rev
+}
+
+func messageContentChanged(before, after *Message) bool {
+	return before.Type != after.Type || before.Text != after.Text || before.File != after.File || before.IsAds != after.IsAds
+}
+
+// setMessageEditor notes the editor on the edited message, for edits that
+// change its content.
+func setMessageEditor(before, after *Message, editorId, editor string) {
+	if !messageContentChanged(before, after) {
+		return
+	}
+
+	after.LastEditorId = editorId
+	after.LastEditor = editor
+}
+
+// recordMessageRevision keeps the content before a saved edit in the message
+// history. Edits that only restore a deleted message add no revision.
+func recordMessageRevision(ctx context.Context, before, after *Message) {
+	if !messageContentChanged(before, after) {
+		return
+	}
+
+	if _, err := dbAddMessageRevision(ctx, before.ID, messageRevision(before)); err != nil {
+		log.Printf("Failed to save revision of message %d: %v\n", before.ID, err)
+	}
+}
+
+func getMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	message, err := dbGetMessage(ctx, id, true, false)
+	if err != nil {
+		log.Printf("Failed to get message: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	if message == nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := dbGetMessageRevisions(ctx, id)
+	if err != nil {
+		log.Printf("Failed to get revisions of message %d: %v\n", id, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// restoreMessageRevision brings back the content of a revision as a new
+// edit, so the content it replaces is kept in the history too. Like
+// updateMessage it honors If-Match, so a restore does not undo an edit the
+// admin has not seen.
+func restoreMessageRevision(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	revision, err := strconv.Atoi(chi.URLParam(r, "revision"))
+	if err != nil {
+		http.Error(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, "invalid If-Match header", http.StatusBadRequest)
+		return
+	}
+
+	message, err := dbGetMessage(ctx, id, true, settingConfig.CountViews)
+	if err != nil {
+		log.Printf("Failed to get message: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	if message == nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	rev, err := dbGetMessageRevision(ctx, id, revision)
+	if err != nil {
+		log.Printf("Failed to get revision %d of message %d: %v\n", revision, id, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	if rev == nil {
+		http.Error(w, "revision not found", http.StatusNotFound)
+		return
+	}
+
+	session, _ := store.Get(r, cookieName)
+	user, _ := session.Values["user"].(Session)
+
+	before := *message
+	message.Type = rev.Type
+	message.Text = rev.Text
+	message.File = rev.File
+	message.IsAds = rev.IsAds
+	message.LastEdit = time.Now()
+	setMessageEditor(&before, message, user.ID, user.PublicName)
+
+	if err := editMessage(ctx, &before, message, ifVersion); err != nil {
+		switch {
+		case errors.Is(err, errMessageVersionConflict):
+			http.Error(w, "message was changed by another edit", http.StatusPreconditionFailed)
+		case errors.Is(err, errMessageNotFound):
+			http.Error(w, "message not found", http.StatusNotFound)
+		default:
+			log.Printf("Failed to restore message %d: %v\n", id, err)
+			http.Error(w, "error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	go SendWebhook(context.Background(), WebhookUpdate, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", messageETag(message))
+	json.NewEncoder(w).Encode(message)
+}
@@ -12,6 +12,9 @@ func init() {
 		ticker := time.NewTicker(1 * time.Minute)
 		defer ticker.Stop()
 		for range ticker.C {
+			expirePinnedMessages()
+			purgeExpiredMessages()
+
 			ctxGet, cancelGet := context.WithTimeout(context.Background(), 5*time.Second)
 			list, err := dbGetScheduledMessages(ctxGet)
 			cancelGet()
@@ -32,7 +35,7 @@ func init() {
 						m.Author = "Scheduled"
 						m.AuthorId = "0"
 						setMessage(ctx, m, false)
-						go SendWebhook(context.Background(), "create", m)
+						go SendWebhook(context.Background(), WebhookCreate, m)
 						go pushFcmMessage(m)
 					}(&msg)
 					//*list = slices.Delete(*list, i, i+1)
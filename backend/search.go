@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	searchIndexVersion  = "1"
+	minSearchTermLength = 2
+	maxSearchTermLength = 64
+	maxSearchQueryTerms = 10
+)
+
+var hebrewFinalLetters = strings.NewReplacer("ך", "כ", "ם", "מ", "ן", "נ", "ף", "פ", "ץ", "צ")
+
+func searchMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := r.URL.Query().Get("q")
+	offsetFromClient := r.URL.Query().Get("offset")
+	limitFromClient := r.URL.Query().Get("limit")
+
+	offset, err := strconv.Atoi(offsetFromClient)
+	if err != nil {
+		offset = 0
+	}
+
+	limit, err := strconv.Atoi(limitFromClient)
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	terms := searchTerms(query)
+	if len(terms) > maxSearchQueryTerms {
+		terms = terms[:maxSearchQueryTerms]
+	}
+
+	messages := []Message{}
+	if len(terms) > 0 {
+		isAdmin := checkPrivilege(r, Writer)
+		messages, err = dbSearchMessages(ctx, terms, int64(offset), int64(limit), isAdmin, settingConfig.CountViews)
+		if errors.Is(err, errCursorNotFound) {
+			http.Error(w, "message not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to search messages: %v\n", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		attachReplyPreviews(ctx, messages, isAdmin)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// normalizeSearchText lower-cases the text, strips Hebrew niqqud and
+// cantillation marks and folds final letters to their regular form, so that
+// "שָׁלוֹם" and "שלום" produce the same terms.
+func normalizeSearchText(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if unicode.Is(unicode.Hebrew, r) && unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	return hebrewFinalLetters.Replace(b.String())
+}
+
+func isAcronymMark(r rune) bool {
+	return r == '"' || r == '\'' || r == '״' || r == '׳'
+}
+
+// searchTerms splits text into unique normalized terms. Quote marks inside a
+// word are dropped so Hebrew acronyms like צה"ל index as a single term.
+func searchTerms(text string) []string {
+	runes := []rune(normalizeSearchText(text))
+	seen := make(map[string]bool)
+	terms := []string{}
+	word := []rune{}
+
+	flush := func() {
+		if len(word) >= minSearchTermLength && len(word) <= maxSearchTermLength {
+			term := string(word)
+			if !seen[term] {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+		word = word[:0]
+	}
+
+	for i, r := range runes {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		if isAcronymMark(r) && len(word) > 0 && i+1 < len(runes) && unicode.IsLetter(runes[i+1]) {
+			continue
+		}
+		flush()
+	}
+	flush()
+
+	return terms
+}
+
+// reindexSearch builds the search index for messages that were stored before
+// the index existed. It runs once per index version.
+func reindexSearch() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	version, err := rdb.Get(ctx, "search:version").Result()
+	cancel()
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to get search index version: %v\n", err)
+		return
+	}
+	if version == searchIndexVersion {
+		return
+	}
+
+	log.Println("Building search index...")
+
+	var start int64
+	const batchSize = 500
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		keys, err := rdb.ZRange(ctx, "m_times:1", start, start+batchSize-1).Result()
+		if err != nil {
+			cancel()
+			log.Printf("Failed to build search index: %v\n", err)
+			return
+		}
+
+		for _, key := range keys {
+			id, err := strconv.Atoi(strings.TrimPrefix(key, "messages:"))
+			if err != nil {
+				continue
+			}
+			text, err := rdb.HGet(ctx, key, "text").Result()
+			if err != nil {
+				continue
+			}
+			if err := dbIndexMessage(ctx, id, text, time.Time{}); err != nil {
+				log.Printf("Failed to index message %d: %v\n", id, err)
+			}
+		}
+		cancel()
+
+		if len(keys) < batchSize {
+			break
+		}
+		start += batchSize
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rdb.Set(ctx, "search:version", searchIndexVersion, 0)
+
+	log.Println("Search index is ready")
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"channel/markdown"
+)
+
+const (
+	metaTitleLength       = 70
+	metaDescriptionLength = 200
+
+	// sitemapPageSize keeps each sitemap well under the 50,000 URLs the
+	// protocol allows.
+	sitemapPageSize = 10000
+)
+
+// PageMeta is what link previews (WhatsApp, Telegram, search engines) read
+// from the page, since they do not run the client.
+type PageMeta struct {
+	Title       string
+	SiteName    string
+	Description string
+	URL         string
+	Image       string
+	Published   time.Time
+	Feeds       bool
+}
+
+// pageMeta describes the requested page, a message for /message/{id} and the
+// channel for every other path. ok is false when the channel requires auth,
+// in which case nothing about it is put in the page.
+func pageMeta(r *http.Request) (*PageMeta, bool) {
+	if settingConfig.RequireAuth {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := getChannelDetails(ctx)
+	if err != nil {
+		log.Printf("Failed to get channel details: %v\n", err)
+		return nil, false
+	}
+
+	// Without project_domain the page has no known address, and the Host
+	// header is up to the client, so the tags that need one are left out.
+	base := projectURL()
+	meta := &PageMeta{
+		Title:       c["name"],
+		SiteName:    c["name"],
+		Description: c["description"],
+		URL:         absoluteSiteURL(base, "/"),
+		Feeds:       true,
+	}
+	if c["logoUrl"] != "" {
+		meta.Image = absoluteSiteURL(base, c["logoUrl"])
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return meta, true
+	}
+
+	m, err := dbGetMessage(ctx, id, false, false)
+	if err != nil {
+		log.Printf("Failed to get message %d: %v\n", id, err)
+	}
+	if m == nil {
+		return meta, true
+	}
+
+	meta.URL = absoluteSiteURL(base, messageURL("", m.ID))
+	meta.Published = m.Timestamp
+	if excerpt := markdown.Excerpt(m.Text, metaDescriptionLength); excerpt != "" {
+		meta.Title = markdown.Excerpt(m.Text, metaTitleLength)
+		meta.Description = excerpt
+	}
+
+	if !settingConfig.RequireAuthForViewFiles {
+		for _, fileId := range messageFileIds(m) {
+			info, err := getFileInfo(fileId)
+			if err == nil && info != nil && strings.HasPrefix(info.MimeType, "image/") {
+				meta.Image = absoluteSiteURL(base, "/api/files/"+info.ID)
+				break
+			}
+		}
+	}
+
+	return meta, true
+}
+
+// absoluteSiteURL resolves a path on the site against base. It returns ""
+// for a path when base is not known, since previews need absolute URLs.
+func absoluteSiteURL(base, u string) string {
+	if strings.HasPrefix(u, "/") {
+		if base == "" {
+			return ""
+		}
+		return base + u
+	}
+	return u
+}
+
+// TitleTag renders the title of the page, which takes the place of the empty
+// one in index.html unless a custom title is set.
+func (m *PageMeta) TitleTag() string {
+	title := m.Title
+	if title != m.SiteName && m.SiteName != "" {
+		title += " - " + m.SiteName
+	}
+
+	return "<title>" + html.EscapeString(title) + "</title>"
+}
+
+// Tags renders the meta and link tags that go at the end of the head.
+func (m *PageMeta) Tags() string {
+	var b strings.Builder
+	tag := func(format string, values ...string) {
+		escaped := make([]any, len(values))
+		for i, v := range values {
+			escaped[i] = html.EscapeString(v)
+		}
+		b.WriteString(fmt.Sprintf(format, escaped...) + "\n")
+	}
+
+	if m.URL != "" {
+		tag(`<link rel="canonical" href="%s">`, m.URL)
+	}
+	if m.Description != "" {
+		tag(`<meta name="description" content="%s">`, m.Description)
+	}
+
+	ogType := "website"
+	if !m.Published.IsZero() {
+		ogType = "article"
+	}
+	tag(`<meta property="og:type" content="%s">`, ogType)
+	tag(`<meta property="og:site_name" content="%s">`, m.SiteName)
+	tag(`<meta property="og:title" content="%s">`, m.Title)
+	tag(`<meta property="og:description" content="%s">`, m.Description)
+	if m.URL != "" {
+		tag(`<meta property="og:url" content="%s">`, m.URL)
+	}
+	if !m.Published.IsZero() {
+		tag(`<meta property="article:published_time" content="%s">`, m.Published.UTC().Format(time.RFC3339))
+	}
+
+	card := "summary"
+	if m.Image != "" {
+		card = "summary_large_image"
+		tag(`<meta property="og:image" content="%s">`, m.Image)
+		tag(`<meta name="twitter:image" content="%s">`, m.Image)
+	}
+	tag(`<meta name="twitter:card" content="%s">`, card)
+	tag(`<meta name="twitter:title" content="%s">`, m.Title)
+	tag(`<meta name="twitter:description" content="%s">`, m.Description)
+
+	if m.Feeds {
+		tag(`<link rel="alternate" type="application/rss+xml" title="%s" href="/feed.rss">`, m.SiteName)
+		tag(`<link rel="alternate" type="application/atom+xml" title="%s" href="/feed.atom">`, m.SiteName)
+	}
+
+	return b.String()
+}
+
+type SitemapEntry struct {
+	ID        int
+	Timestamp time.Time
+	LastEdit  time.Time
+}
+
+// Sitemaps protocol, https://www.sitemaps.org/protocol.html
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+const sitemapXmlns = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+// getSitemap serves the message permalinks. Up to sitemapPageSize messages it
+// is a single sitemap, beyond that /sitemap.xml is an index of
+// /sitemap.xml?page=N, oldest messages first so pages stay stable as the
+// channel grows. Sitemaps need absolute URLs, so without project_domain
+// there is none.
+func getSitemap(w http.ResponseWriter, r *http.Request) {
+	base := projectURL()
+	if !settingConfig.SitemapEnabled || settingConfig.RequireAuth || base == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := dbCountMessages(ctx)
+	if err != nil {
+		log.Printf("Failed to count messages: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	pages := max(1, (total+sitemapPageSize-1)/sitemapPageSize)
+
+	pageParam := r.URL.Query().Get("page")
+	if pageParam == "" && pages > 1 {
+		index := sitemapIndex{Xmlns: sitemapXmlns}
+		for page := int64(1); page <= pages; page++ {
+			index.Sitemaps = append(index.Sitemaps, sitemapURL{Loc: fmt.Sprintf("%s/sitemap.xml?page=%d", base, page)})
+		}
+		writeXMLFeed(w, "application/xml", index)
+		return
+	}
+
+	page := int64(1)
+	if pageParam != "" {
+		page, err = strconv.ParseInt(pageParam, 10, 64)
+		if err != nil || page < 1 || page > pages {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	start := (page - 1) * sitemapPageSize
+	entries, err := dbGetSitemapEntries(ctx, start, start+sitemapPageSize-1)
+	if err != nil {
+		log.Printf("Failed to get sitemap entries: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	urlSet := sitemapURLSet{Xmlns: sitemapXmlns}
+	if page == 1 {
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{Loc: base + "/"})
+	}
+	for _, entry := range entries {
+		lastMod := entry.LastEdit
+		if lastMod.IsZero() || lastMod.Before(entry.Timestamp) {
+			lastMod = entry.Timestamp
+		}
+
+		u := sitemapURL{Loc: messageURL(base, entry.ID)}
+		if !lastMod.IsZero() {
+			u.LastMod = lastMod.UTC().Format(time.RFC3339)
+		}
+		urlSet.URLs = append(urlSet.URLs, u)
+	}
+
+	writeXMLFeed(w, "application/xml", urlSet)
+}
+
+func getRobots(w http.ResponseWriter, r *http.Request) {
+	if !settingConfig.RobotsEnabled || settingConfig.RequireAuth {
+		http.NotFound(w, r)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	b.WriteString("Allow: /\n")
+	b.WriteString("Allow: /api/files/\n")
+	b.WriteString("Disallow: /api/\n")
+	b.WriteString("Disallow: /login\n")
+	b.WriteString("Disallow: /activitypub/\n")
+	if base := projectURL(); settingConfig.SitemapEnabled && base != "" {
+		b.WriteString("\nSitemap: " + base + "/sitemap.xml\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
@@ -24,6 +25,11 @@ type SettingConfig struct {
 	RegexReplace            []*ReplaceRegex
 	WebhookURL              string
 	VerifyToken             string
+	WebhookSecret           string
+	WebhookPreviousSecret   string
+	WebhookPreviousUntil    time.Time
+	WebhookSkipTLSVerify    bool
+	WebhookEvents           []string
 	ApiSecretKey            string
 	RootStaticFolder        string
 	CountViews              bool
@@ -41,6 +47,11 @@ type SettingConfig struct {
 	MaxFileSize             int64
 	CustomTitle             string
 	ContactUs               string
+	ActivityPubEnabled      bool
+	ActivityPubUsername     string
+	SitemapEnabled          bool
+	RobotsEnabled           bool
+	DeletedRetentionDays    int64
 }
 
 type Setting struct {
@@ -75,6 +86,8 @@ func (s *Settings) ToConfig() *SettingConfig {
 	}
 
 	config.MaxFileSize = 100
+	config.WebhookEvents = []string{WebhookCreate, WebhookUpdate, WebhookDelete}
+	config.ActivityPubUsername = "channel"
 
 	for _, setting := range *s {
 		switch setting.Key {
@@ -96,6 +109,23 @@ func (s *Settings) ToConfig() *SettingConfig {
 		case "webhook_verify_token":
 			config.VerifyToken = setting.GetString()
 
+		case "webhook_secret":
+			config.WebhookSecret = setting.GetString()
+
+		case "webhook_previous_secret":
+			config.WebhookPreviousSecret = setting.GetString()
+
+		case "webhook_previous_secret_until":
+			config.WebhookPreviousUntil = setting.GetTime()
+
+		case "webhook_skip_tls_verify":
+			config.WebhookSkipTLSVerify = setting.GetBool()
+
+		case "webhook_events":
+			if events := setting.GetString(); events != "" {
+				config.WebhookEvents = strings.Split(strings.ReplaceAll(events, " ", ""), ",")
+			}
+
 		case "api_secret_key":
 			config.ApiSecretKey = setting.GetString()
 
@@ -186,6 +216,23 @@ func (s *Settings) ToConfig() *SettingConfig {
 
 		case "contact_us":
 			config.ContactUs = setting.GetString()
+
+		case "activitypub_enabled":
+			config.ActivityPubEnabled = setting.GetBool()
+
+		case "activitypub_username":
+			if username := setting.GetString(); username != "" {
+				config.ActivityPubUsername = username
+			}
+
+		case "deleted_retention_days":
+			config.DeletedRetentionDays = setting.GetInt()
+
+		case "sitemap_enabled":
+			config.SitemapEnabled = setting.GetBool()
+
+		case "robots_enabled":
+			config.RobotsEnabled = setting.GetBool()
 		}
 	}
 
@@ -207,6 +254,16 @@ func (s *Setting) GetInt() int64 {
 	return i
 }
 
+// GetTime accepts either a full RFC 3339 timestamp or a plain date.
+func (s *Setting) GetTime() time.Time {
+	str := s.GetString()
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t
+	}
+	t, _ := time.Parse(time.DateOnly, str)
+	return t
+}
+
 func setSettings(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -217,6 +274,12 @@ func setSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	oldSettings, err := dbGetSettings(ctx)
+	if err != nil {
+		http.Error(w, "error getting settings", http.StatusInternalServerError)
+		return
+	}
+
 	if err := dbSetSettings(ctx, &newSettings); err != nil {
 		http.Error(w, "error saving settings", http.StatusInternalServerError)
 		return
@@ -224,6 +287,14 @@ func setSettings(w http.ResponseWriter, r *http.Request) {
 
 	settingConfig = newSettings.ToConfig()
 
+	session, _ := store.Get(r, cookieName)
+	user, _ := session.Values["user"].(Session)
+	go sendWebhookEvent(context.Background(), WebhookPayload{
+		Action:   WebhookSettings,
+		Settings: &WebhookSettingsBody{Changed: changedSettingKeys(oldSettings, newSettings)},
+		Actor:    webhookUserFromSession(user),
+	})
+
 	res := Response{
 		Success: true,
 	}
@@ -231,6 +302,29 @@ func setSettings(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+// changedSettingKeys returns the keys that were added, removed or given a
+// different value.
+func changedSettingKeys(oldSettings, newSettings Settings) []string {
+	values := make(map[string]any)
+	for _, setting := range oldSettings {
+		values[setting.Key] = setting.Value
+	}
+
+	changed := []string{}
+	for _, setting := range newSettings {
+		oldValue, ok := values[setting.Key]
+		if !ok || fmt.Sprint(oldValue) != fmt.Sprint(setting.Value) {
+			changed = append(changed, setting.Key)
+		}
+		delete(values, setting.Key)
+	}
+	for key := range values {
+		changed = append(changed, key)
+	}
+
+	return changed
+}
+
 func getSettings(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
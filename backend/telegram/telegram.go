@@ -0,0 +1,270 @@
+// Package telegram reads channel exports made by Telegram Desktop ("Export
+// chat history" in JSON format) and converts message entities to the markdown
+// TheChannel messages are written in.
+//
+// An export is a directory holding result.json and the media folders it
+// refers to (photos, files, video_files and so on). Paths in result.json are
+// relative to that directory.
+package telegram
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResultFile is the name of the JSON file at the root of an export.
+const ResultFile = "result.json"
+
+// notIncludedPrefix starts the file path of media that was skipped by the
+// export settings.
+const notIncludedPrefix = "(File not included"
+
+var ErrNoResultFile = errors.New("telegram: " + ResultFile + " not found")
+
+type Export struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	ID       int64     `json:"id"`
+	Messages []Message `json:"messages"`
+}
+
+type Message struct {
+	ID               int        `json:"id"`
+	Type             string     `json:"type"` // "message" or "service"
+	Date             string     `json:"date"`
+	DateUnix         string     `json:"date_unixtime"`
+	Edited           string     `json:"edited"`
+	EditedUnix       string     `json:"edited_unixtime"`
+	From             string     `json:"from"`
+	Author           string     `json:"author"` // post signature
+	TextEntities     []Entity   `json:"text_entities"`
+	Photo            string     `json:"photo"`
+	File             string     `json:"file"`
+	FileName         string     `json:"file_name"`
+	MediaType        string     `json:"media_type"`
+	MimeType         string     `json:"mime_type"`
+	Views            int        `json:"views"`
+	Reactions        []Reaction `json:"reactions"`
+	ReplyToMessageId int        `json:"reply_to_message_id"`
+}
+
+type Entity struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Href     string `json:"href"`
+	Language string `json:"language"`
+}
+
+type Reaction struct {
+	Type  string `json:"type"` // "emoji", "custom_emoji" or "paid"
+	Count int    `json:"count"`
+	Emoji string `json:"emoji"`
+}
+
+// Load reads result.json from the export directory.
+func Load(dir string) (*Export, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ResultFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNoResultFile
+		}
+		return nil, err
+	}
+
+	var export Export
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("telegram: invalid %s: %w", ResultFile, err)
+	}
+
+	return &export, nil
+}
+
+// FindExportDir returns the directory holding result.json under root. Zipped
+// exports usually wrap it in a "ChatExport_<date>" folder.
+func FindExportDir(root string) (string, error) {
+	var found string
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() == ResultFile {
+			found = filepath.Dir(path)
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", ErrNoResultFile
+	}
+
+	return found, nil
+}
+
+// IsPost reports whether the message is channel content, as opposed to a
+// service message such as "channel created" or "message pinned".
+func (m *Message) IsPost() bool {
+	return m.Type == "message"
+}
+
+// Time returns when the message was sent. date_unixtime is preferred since
+// date is in the local time of the exporting computer.
+func (m *Message) Time() (time.Time, error) {
+	return parseTime(m.DateUnix, m.Date)
+}
+
+// EditTime returns when the message was last edited, or the zero time.
+func (m *Message) EditTime() time.Time {
+	t, _ := parseTime(m.EditedUnix, m.Edited)
+	return t
+}
+
+func parseTime(unix, local string) (time.Time, error) {
+	if unix != "" {
+		sec, err := strconv.ParseInt(unix, 10, 64)
+		if err == nil {
+			return time.Unix(sec, 0).UTC(), nil
+		}
+	}
+	if local == "" {
+		return time.Time{}, errors.New("telegram: missing date")
+	}
+
+	return time.Parse("2006-01-02T15:04:05", local)
+}
+
+// Attachment returns the path of the message media relative to the export
+// directory. ok is false when there is no media or it was not exported.
+func (m *Message) Attachment() (path string, name string, ok bool) {
+	path = m.Photo
+	if path == "" {
+		path = m.File
+	}
+	if path == "" || strings.HasPrefix(path, notIncludedPrefix) || !filepath.IsLocal(path) {
+		return "", "", false
+	}
+
+	name = m.FileName
+	if name == "" {
+		name = filepath.Base(path)
+	}
+
+	return path, name, true
+}
+
+// ReactionCounts returns the count of each emoji reaction. Custom emoji and
+// paid reactions have no portable form and are left out.
+func (m *Message) ReactionCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, r := range m.Reactions {
+		if r.Type == "emoji" && r.Emoji != "" && r.Count > 0 {
+			counts[r.Emoji] += r.Count
+		}
+	}
+
+	return counts
+}
+
+// Markdown converts the message text entities to markdown.
+func (m *Message) Markdown() string {
+	return EntitiesToMarkdown(m.TextEntities)
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "~", `\~`,
+	"[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "|", `\|`,
+)
+
+// EntitiesToMarkdown renders Telegram text entities as markdown. Plain text is
+// escaped so characters like "*" are not taken as formatting.
+func EntitiesToMarkdown(entities []Entity) string {
+	var b strings.Builder
+	for _, e := range entities {
+		switch e.Type {
+		case "bold":
+			b.WriteString(wrap(escape(e.Text), "**", "**"))
+		case "italic":
+			b.WriteString(wrap(escape(e.Text), "_", "_"))
+		case "underline":
+			b.WriteString(wrap(escape(e.Text), "<u>", "</u>"))
+		case "strikethrough":
+			b.WriteString(wrap(escape(e.Text), "~~", "~~"))
+		case "code":
+			b.WriteString(wrap(e.Text, "`", "`"))
+		case "pre":
+			b.WriteString(ensureLineStart(b.String()))
+			b.WriteString("```" + e.Language + "\n" + strings.TrimSuffix(e.Text, "\n") + "\n```\n")
+		case "text_link":
+			if href, ok := linkDestination(e.Href); ok {
+				b.WriteString(wrap(escape(e.Text), "[", "]("+href+")"))
+			} else {
+				b.WriteString(escape(e.Text))
+			}
+		case "link", "email", "phone":
+			b.WriteString(e.Text)
+		case "blockquote":
+			b.WriteString(ensureLineStart(b.String()))
+			lines := strings.Split(strings.TrimSuffix(escape(e.Text), "\n"), "\n")
+			b.WriteString("> " + strings.Join(lines, "\n> ") + "\n\n")
+		default:
+			// plain, mention, hashtag, spoiler, custom_emoji and the rest
+			b.WriteString(escape(e.Text))
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+func escape(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// linkSchemes are the schemes a text_link may point to. Links with any other
+// scheme, like javascript:, keep only their text.
+var linkSchemes = map[string]bool{"http": true, "https": true, "tg": true}
+
+// linkEscaper percent-encodes the characters that would end a markdown link
+// destination early.
+var linkEscaper = strings.NewReplacer(
+	"(", "%28", ")", "%29", " ", "%20", "<", "%3C", ">", "%3E", `\`, "%5C",
+)
+
+// linkDestination returns the href escaped for a markdown link, or false when
+// its scheme is not allowed.
+func linkDestination(href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil || !linkSchemes[strings.ToLower(u.Scheme)] {
+		return "", false
+	}
+
+	return linkEscaper.Replace(href), true
+}
+
+// wrap puts the markers around the text, keeping surrounding whitespace
+// outside of them since "** bold**" is not rendered as bold.
+func wrap(text, open, close string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+
+	start := strings.Index(text, trimmed)
+	return text[:start] + open + trimmed + close + text[start+len(trimmed):]
+}
+
+func ensureLineStart(written string) string {
+	if written == "" || strings.HasSuffix(written, "\n") {
+		return ""
+	}
+
+	return "\n"
+}
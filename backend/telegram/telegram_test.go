@@ -0,0 +1,240 @@
+package telegram
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := FindExportDir("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(dir) != "ChatExport_2024-05-01" {
+		t.Fatalf("FindExportDir = %s", dir)
+	}
+
+	export, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.Name != "Test Channel" || export.ID != 1234567890 || len(export.Messages) != 4 {
+		t.Fatalf("unexpected export: %s %d with %d messages", export.Name, export.ID, len(export.Messages))
+	}
+
+	service, post, reply, missing := export.Messages[0], export.Messages[1], export.Messages[2], export.Messages[3]
+	if service.IsPost() || !post.IsPost() {
+		t.Error("IsPost does not tell posts from service messages")
+	}
+
+	if sent, err := post.Time(); err != nil || !sent.Equal(time.Unix(1714557600, 0)) {
+		t.Errorf("Time = %v, %v", sent, err)
+	}
+	if edited := post.EditTime(); !edited.Equal(time.Unix(1714557900, 0)) {
+		t.Errorf("EditTime = %v", edited)
+	}
+	if !reply.EditTime().IsZero() {
+		t.Errorf("EditTime of an unedited message = %v", reply.EditTime())
+	}
+
+	if got := post.Markdown(); got != "**Hello** world [site](https://example.com/a_%28b%29)" {
+		t.Errorf("Markdown = %q", got)
+	}
+	if got := reply.Markdown(); got != `2 \* 3` {
+		t.Errorf("Markdown = %q", got)
+	}
+
+	if counts := post.ReactionCounts(); len(counts) != 1 || counts["👍"] != 3 {
+		t.Errorf("ReactionCounts = %v", counts)
+	}
+	if post.Views != 120 || post.Author != "Editor" || reply.ReplyToMessageId != 2 {
+		t.Errorf("unexpected fields: views %d, author %q, reply to %d", post.Views, post.Author, reply.ReplyToMessageId)
+	}
+
+	path, name, ok := post.Attachment()
+	if !ok || name != "photo_1@01-05-2024_10-00-00.jpg" {
+		t.Fatalf("Attachment = %q, %q, %v", path, name, ok)
+	}
+	if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+		t.Errorf("attachment is not in the export: %v", err)
+	}
+	if path, name, ok := reply.Attachment(); !ok || path != "files/notes.txt" || name != "notes.txt" {
+		t.Errorf("Attachment = %q, %q, %v", path, name, ok)
+	}
+	if _, _, ok := missing.Attachment(); ok {
+		t.Error("media that was not exported has an attachment")
+	}
+}
+
+func TestLoadMissingResult(t *testing.T) {
+	if _, err := Load(t.TempDir()); !errors.Is(err, ErrNoResultFile) {
+		t.Errorf("Load = %v, want %v", err, ErrNoResultFile)
+	}
+	if _, err := FindExportDir(t.TempDir()); !errors.Is(err, ErrNoResultFile) {
+		t.Errorf("FindExportDir = %v, want %v", err, ErrNoResultFile)
+	}
+}
+
+func TestAttachmentPathGuard(t *testing.T) {
+	for _, path := range []string{
+		"../secret.txt",
+		"photos/../../secret.txt",
+		"/etc/passwd",
+		"",
+	} {
+		m := Message{File: path}
+		if got, _, ok := m.Attachment(); ok {
+			t.Errorf("Attachment(%q) = %q, want none", path, got)
+		}
+	}
+}
+
+func TestEntitiesToMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		entities []Entity
+		want     string
+	}{
+		{
+			name:     "plain text is escaped",
+			entities: []Entity{{Type: "plain", Text: "a*b_c [d] <e>"}},
+			want:     `a\*b\_c \[d\] \<e\>`,
+		},
+		{
+			name: "formatting keeps whitespace outside the markers",
+			entities: []Entity{
+				{Type: "bold", Text: "bold "},
+				{Type: "italic", Text: "italic"},
+				{Type: "plain", Text: " "},
+				{Type: "strikethrough", Text: "gone"},
+				{Type: "plain", Text: " "},
+				{Type: "underline", Text: "under"},
+			},
+			want: "**bold** _italic_ ~~gone~~ <u>under</u>",
+		},
+		{
+			name: "code is not escaped",
+			entities: []Entity{
+				{Type: "code", Text: "a*b"},
+				{Type: "pre", Text: "x := 1\n", Language: "go"},
+			},
+			want: "`a*b`\n```go\nx := 1\n```",
+		},
+		{
+			name: "blockquote",
+			entities: []Entity{
+				{Type: "plain", Text: "said"},
+				{Type: "blockquote", Text: "one\ntwo"},
+			},
+			want: "said\n> one\n> two",
+		},
+		{
+			name:     "text link",
+			entities: []Entity{{Type: "text_link", Text: "here", Href: "https://example.com/x?q=1"}},
+			want:     "[here](https://example.com/x?q=1)",
+		},
+		{
+			name:     "text link cannot break out of the destination",
+			entities: []Entity{{Type: "text_link", Text: "here", Href: "https://example.com/a) [x](javascript:alert(1)"}},
+			want:     "[here](https://example.com/a%29%20[x]%28javascript:alert%281%29)",
+		},
+		{
+			name:     "telegram links are kept",
+			entities: []Entity{{Type: "text_link", Text: "join", Href: "tg://join?invite=abc"}},
+			want:     "[join](tg://join?invite=abc)",
+		},
+		{
+			name: "other schemes keep only the text",
+			entities: []Entity{
+				{Type: "text_link", Text: "click", Href: "javascript:alert(1)"},
+				{Type: "plain", Text: " "},
+				{Type: "text_link", Text: "data", Href: "data:text/html,x"},
+				{Type: "plain", Text: " "},
+				{Type: "text_link", Text: "relative", Href: "/admin"},
+			},
+			want: "click data relative",
+		},
+		{
+			name:     "links are written as they are",
+			entities: []Entity{{Type: "link", Text: "https://example.com/a_b"}},
+			want:     "https://example.com/a_b",
+		},
+	}
+	for _, tt := range tests {
+		if got := EntitiesToMarkdown(tt.entities); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func zipArchive(t *testing.T, files map[string]string) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestUnzip(t *testing.T) {
+	archive := zipArchive(t, map[string]string{
+		"ChatExport/result.json":     `{"name":"x","messages":[]}`,
+		"ChatExport/photos/a.jpg":    "jpeg",
+		"ChatExport/files/empty.txt": "",
+	})
+
+	dir := t.TempDir()
+	if err := Unzip(archive, archive.Size(), dir, 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	exportDir, err := FindExportDir(dir)
+	if err != nil || exportDir != filepath.Join(dir, "ChatExport") {
+		t.Fatalf("FindExportDir = %s, %v", exportDir, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(exportDir, "photos", "a.jpg")); err != nil || string(data) != "jpeg" {
+		t.Errorf("extracted %q, %v", data, err)
+	}
+}
+
+func TestUnzipSizeLimit(t *testing.T) {
+	archive := zipArchive(t, map[string]string{
+		"a.txt": strings.Repeat("a", 600),
+		"b.txt": strings.Repeat("b", 600),
+	})
+
+	// each file fits, both together do not
+	if err := Unzip(archive, archive.Size(), t.TempDir(), 1000); !errors.Is(err, ErrZipTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrZipTooLarge)
+	}
+	if err := Unzip(archive, archive.Size(), t.TempDir(), 1200); err != nil {
+		t.Errorf("exactly at the limit: %v", err)
+	}
+}
+
+func TestUnzipPathGuard(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "a/../../evil.txt", "/evil.txt"} {
+		archive := zipArchive(t, map[string]string{name: "x"})
+		dir := t.TempDir()
+		if err := Unzip(archive, archive.Size(), filepath.Join(dir, "out"), 1<<10); err == nil {
+			t.Errorf("%s: extracted outside the directory", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "evil.txt")); err == nil {
+			t.Errorf("%s: file written outside the directory", name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package telegram
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var ErrZipTooLarge = errors.New("telegram: zip content too large")
+
+// Unzip extracts a zipped export into dir. limit caps the total size of the
+// extracted files, since the archive size says little about it.
+func Unzip(r io.ReaderAt, size int64, dir string, limit int64) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	budget := limit
+	for _, f := range archive.File {
+		if !filepath.IsLocal(f.Name) {
+			return fmt.Errorf("telegram: invalid path in zip: %s", f.Name)
+		}
+
+		dest := filepath.Join(dir, f.Name)
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			return err
+		}
+
+		written, err := ExtractZipFile(f, dest, budget)
+		if err != nil {
+			return err
+		}
+		budget -= written
+	}
+
+	return nil
+}
+
+// ExtractZipFile writes f to dest and returns the number of bytes written. It
+// stops with ErrZipTooLarge once more than limit bytes come out of the file,
+// whatever its header claims.
+func ExtractZipFile(f *zip.File, dest string, limit int64) (int64, error) {
+	src, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	written, err := io.CopyN(out, src, limit+1)
+	if err != nil && err != io.EOF {
+		return written, err
+	}
+	if written > limit {
+		return written, ErrZipTooLarge
+	}
+
+	return written, nil
+}
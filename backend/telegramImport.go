@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"channel/telegram"
+)
+
+// importTelegramExport backfills the posts of a Telegram Desktop export
+// directory. Posts are keyed by "telegram:<channel id>:<message id>", so
+// running it again over the same export only adds what is missing.
+func importTelegramExport(dir string) (*BulkImportResponse, error) {
+	export, err := telegram.Load(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &BulkImportResponse{Results: []BulkImportResult{}}
+
+	for i, tm := range export.Messages {
+		if !tm.IsPost() {
+			continue
+		}
+
+		result := BulkImportResult{
+			Index:      i,
+			ExternalId: fmt.Sprintf("telegram:%d:%d", export.ID, tm.ID),
+		}
+
+		if err := importTelegramMessage(export, &tm, dir, &result); err != nil {
+			log.Printf("Failed to import telegram message %d: %v\n", tm.ID, err)
+			result.Status = BulkImportFailed
+			result.Error = err.Error()
+		}
+
+		switch result.Status {
+		case BulkImportCreated:
+			response.Created++
+		case BulkImportExisting:
+			response.Existing++
+		default:
+			response.Failed++
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	return response, nil
+}
+
+func importTelegramMessage(export *telegram.Export, tm *telegram.Message, dir string, result *BulkImportResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Checked before the media is stored, so a second run does not leave
+	// unused copies of every file behind.
+	id, err := dbGetMessageIdByExternalId(ctx, result.ExternalId)
+	if err != nil {
+		return err
+	}
+	if id != 0 {
+		result.Status = BulkImportExisting
+		result.ID = id
+		return nil
+	}
+
+	timestamp, err := tm.Time()
+	if err != nil {
+		return err
+	}
+
+	author := tm.Author
+	if author == "" {
+		author = tm.From
+	}
+	if author == "" {
+		author = export.Name
+	}
+
+	message := Message{
+		Type:       "md",
+		Text:       tm.Markdown(),
+		Author:     author,
+		Timestamp:  timestamp,
+		LastEdit:   tm.EditTime(),
+		Views:      tm.Views,
+		Reactions:  tm.ReactionCounts(),
+		ExternalId: result.ExternalId,
+	}
+
+	if tm.ReplyToMessageId != 0 {
+		message.ReplyTo, err = dbGetMessageIdByExternalId(ctx, fmt.Sprintf("telegram:%d:%d", export.ID, tm.ReplyToMessageId))
+		if err != nil {
+			return err
+		}
+	}
+
+	if path, name, ok := tm.Attachment(); ok {
+		file, err := os.Open(filepath.Join(dir, path))
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", path, err)
+		}
+		message.File, err = saveFile(file, name)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to save %s: %v", path, err)
+		}
+	}
+
+	if message.Text == "" && message.File.URL == "" {
+		return errors.New("empty message")
+	}
+
+	m, existing, err := importMessage(ctx, message, "", true)
+	if err != nil {
+		return err
+	}
+
+	result.ID = m.ID
+	result.Status = BulkImportCreated
+	if existing {
+		result.Status = BulkImportExisting
+	}
+
+	return nil
+}
+
+// runTelegramImportCommand implements "the-channel import-telegram <dir>".
+func runTelegramImportCommand(args []string) {
+	if len(args) != 1 {
+		log.Fatal("usage: the-channel import-telegram <export directory>")
+	}
+
+	dir, err := telegram.FindExportDir(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	response, err := importTelegramExport(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Telegram import done: %d created, %d existing, %d failed\n", response.Created, response.Existing, response.Failed)
+	for _, result := range response.Results {
+		if result.Status == BulkImportFailed {
+			log.Printf("%s: %s\n", result.ExternalId, result.Error)
+		}
+	}
+}
+
+// importTelegram accepts a zipped Telegram Desktop export.
+func importTelegram(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(settingConfig.MaxFileSize)<<20)
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		if errors.As(err, &maxBytesReader) {
+			apiError(w, http.StatusRequestEntityTooLarge, "File too large")
+			return
+		}
+		apiError(w, http.StatusBadRequest, "Missing file")
+		return
+	}
+	defer file.Close()
+
+	tmpDir, err := os.MkdirTemp("", "telegram-export-")
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "error")
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := unzipTo(file, tmpDir); err != nil {
+		log.Printf("Failed to extract telegram export: %v\n", err)
+		apiError(w, http.StatusBadRequest, "Invalid zip file")
+		return
+	}
+
+	dir, err := telegram.FindExportDir(tmpDir)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "result.json not found in the export")
+		return
+	}
+
+	response, err := importTelegramExport(dir)
+	if err != nil {
+		log.Printf("Failed to import telegram export: %v\n", err)
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// unzipTo extracts the archive into dir. The extracted size is limited to
+// twice the upload limit, which is plenty for media that is already compressed.
+func unzipTo(file multipart.File, dir string) error {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	return telegram.Unzip(file, size, dir, 2*int64(settingConfig.MaxFileSize)<<20)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/redis/go-redis/v9"
+)
+
+// purgeBatchSize limits the messages purged by the retention policy on each
+// tick, so a long backlog is cleared over a few minutes.
+const purgeBatchSize = 100
+
+type DeletedMessagesResponse struct {
+	Messages []Message `json:"messages"`
+	Total    int64     `json:"total"`
+}
+
+func getDeletedMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	messages, err := dbGetDeletedMessages(ctx, int64(offset), int64(limit), settingConfig.CountViews)
+	if err != nil {
+		log.Printf("Failed to get deleted messages: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	total, err := dbCountDeletedMessages(ctx)
+	if err != nil {
+		log.Printf("Failed to count deleted messages: %v\n", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	attachReplyPreviews(ctx, messages, true)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeletedMessagesResponse{Messages: messages, Total: total})
+}
+
+func restoreDeletedMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := dbRestoreDeletedMessage(ctx, id); err != nil {
+		if errors.Is(err, errMessageNotFound) {
+			http.Error(w, "message is not deleted", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to restore message %d: %v\n", id, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	message, err := dbGetMessage(ctx, id, true, false)
+	if err != nil || message == nil {
+		log.Printf("Failed to get restored message %d: %v\n", id, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	publishMessage(ctx, message, "edit-message")
+	go SendWebhook(context.Background(), WebhookUpdate, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", messageETag(message))
+	json.NewEncoder(w).Encode(message)
+}
+
+func purgeDeletedMessage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	if err := purgeMessage(ctx, id); err != nil {
+		if errors.Is(err, errMessageNotFound) {
+			http.Error(w, "message is not deleted", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to purge message %d: %v\n", id, err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// purgeMessage removes a deleted message for good, along with the files of
+// its current content and its edit history that nothing else links to. Only
+// deleted messages can be purged.
+func purgeMessage(ctx context.Context, id int) error {
+	message, err := dbGetMessage(ctx, id, true, false)
+	if err != nil {
+		return err
+	}
+	if message == nil || !message.Deleted {
+		return errMessageNotFound
+	}
+
+	fileIds := messageFileIds(message)
+	revisions, err := dbGetMessageRevisions(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, rev := range revisions {
+		fileIds = append(fileIds, messageFileIds(&Message{Text: rev.Text, File: rev.File})...)
+	}
+
+	if err := dbPurgeMessage(ctx, message); err != nil {
+		return err
+	}
+
+	// the message is gone from the timeline now, so only other uses are found
+	unused, err := unusedFileIds(ctx, fileIds)
+	if err != nil {
+		// keeping a file is safer than breaking another message
+		log.Printf("Failed to check the files of message %d, keeping them: %v\n", id, err)
+	}
+	for _, fileId := range unused {
+		if err := markFileDeleted(fileId); err != nil {
+			log.Printf("Failed to delete file %s of message %d: %v\n", fileId, id, err)
+		}
+	}
+
+	// only admins still show deleted messages
+	publishEvent(ctx, &PushMessage{Type: "purge-message", M: Message{ID: id, Deleted: true}})
+
+	return nil
+}
+
+// unusedFileIds returns the files among fileIds that are not linked from any
+// message or edit history in the timeline, any scheduled message or the
+// channel logo. The same upload can be linked from several messages, for
+// example when a post is copied.
+func unusedFileIds(ctx context.Context, fileIds []string) ([]string, error) {
+	if len(fileIds) == 0 {
+		return nil, nil
+	}
+
+	inUse, err := dbGetFilesInUse(ctx, fileIds)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduled, err := dbGetScheduledMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := getChannelDetails(ctx)
+	if err != nil {
+		return nil, err
+	}
+	others := append(*scheduled, Message{Text: c["logoUrl"]})
+	for i := range others {
+		for _, fileId := range messageFileIds(&others[i]) {
+			inUse[fileId] = true
+		}
+	}
+
+	unused := []string{}
+	for _, fileId := range fileIds {
+		if !inUse[fileId] && !slices.Contains(unused, fileId) {
+			unused = append(unused, fileId)
+		}
+	}
+
+	return unused, nil
+}
+
+// purgeExpiredMessages applies the retention policy of the trash. It runs on
+// the scheduled messages ticker.
+func purgeExpiredMessages() {
+	if settingConfig.DeletedRetentionDays <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	before := time.Now().AddDate(0, 0, -int(settingConfig.DeletedRetentionDays))
+	ids, err := dbGetExpiredDeletedMessages(ctx, before, purgeBatchSize)
+	if err != nil {
+		log.Printf("Failed to get expired deleted messages: %v\n", err)
+		return
+	}
+
+	for _, id := range ids {
+		if err := purgeMessage(ctx, id); err != nil {
+			if errors.Is(err, errMessageNotFound) {
+				// restored by an edit or already gone, drop the stale entry
+				rdb.ZRem(ctx, "deleted_messages", "messages:"+strconv.Itoa(id))
+				continue
+			}
+			log.Printf("Failed to purge message %d: %v\n", id, err)
+		}
+	}
+}
+
+// indexDeletedMessages adds the messages deleted before the trash existed to
+// it. Their retention period starts when they are added. It runs once.
+func indexDeletedMessages() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	done, err := rdb.Exists(ctx, "deleted_messages:indexed").Result()
+	cancel()
+	if err != nil {
+		log.Printf("Failed to check the trash index: %v\n", err)
+		return
+	}
+	if done == 1 {
+		return
+	}
+
+	now := time.Now()
+	var start int64
+	const batchSize = 500
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		keys, err := rdb.ZRange(ctx, "m_times:1", start, start+batchSize-1).Result()
+		if err != nil {
+			cancel()
+			log.Printf("Failed to index deleted messages: %v\n", err)
+			return
+		}
+
+		for _, key := range keys {
+			if !strings.HasPrefix(key, "messages:") {
+				continue
+			}
+			deleted, err := rdb.HGet(ctx, key, "deleted").Result()
+			if err != nil || deleted != "1" {
+				continue
+			}
+			rdb.HSetNX(ctx, key, "deletedAt", now.Format(time.RFC3339Nano))
+			rdb.ZAddNX(ctx, "deleted_messages", redis.Z{Score: float64(now.Unix()), Member: key})
+		}
+		cancel()
+
+		if len(keys) < batchSize {
+			break
+		}
+		start += batchSize
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rdb.Set(ctx, "deleted_messages:indexed", 1, 0)
+}
@@ -5,66 +5,461 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/redis/go-redis/v9"
+
+	"channel/webhooksig"
 )
 
 // var webhookURL string = os.Getenv("WEBHOOK_URL")
 // var verifyToken string = os.Getenv("WEBHOOK_VERIFY_TOKEN")
 
+const (
+	webhookMaxAttempts     = 10
+	webhookRetryBase       = 30 * time.Second
+	webhookRetryMax        = 6 * time.Hour
+	webhookLease           = 2 * time.Minute
+	webhookPollInterval    = 5 * time.Second
+	webhookBatchSize       = 20
+	webhookKeepDeliveries  = 5000
+	webhookMaxResponseSize = 4 << 10
+)
+
+// Webhook actions. Message actions carry "message", the others carry the body
+// named after them, and audit actions also carry the "actor" who made the change.
+const (
+	WebhookCreate     = "create"
+	WebhookUpdate     = "update"
+	WebhookDelete     = "delete"
+	WebhookReaction   = "reaction"
+	WebhookReport     = "report"
+	WebhookLogin      = "login"
+	WebhookSettings   = "settings"
+	WebhookPrivileges = "privileges"
+)
+
 type WebhookPayload struct {
-	Action      string    `json:"action"`
-	Message     Message   `json:"message"`
-	Timestamp   time.Time `json:"timestamp"`
-	VerifyToken string    `json:"verifyToken"`
+	Action      string                 `json:"action"`
+	Message     *Message               `json:"message,omitempty"`
+	Reaction    *WebhookReactionBody   `json:"reaction,omitempty"`
+	Report      *Report                `json:"report,omitempty"`
+	Login       *WebhookUser           `json:"login,omitempty"`
+	Settings    *WebhookSettingsBody   `json:"settings,omitempty"`
+	Privileges  *WebhookPrivilegesBody `json:"privileges,omitempty"`
+	Actor       *WebhookUser           `json:"actor,omitempty"`
+	Timestamp   time.Time              `json:"timestamp"`
+	VerifyToken string                 `json:"verifyToken"`
+}
+
+type WebhookReactionBody struct {
+	MessageId int       `json:"messageId"`
+	Emoji     string    `json:"emoji"`
+	UserId    string    `json:"userId"`
+	Removed   bool      `json:"removed"`
+	Reactions Reactions `json:"reactions"`
+}
+
+type WebhookUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// WebhookSettingsBody lists the keys that changed, values are left out since
+// many settings are secrets.
+type WebhookSettingsBody struct {
+	Changed []string `json:"changed"`
+}
+
+type WebhookPrivilegesBody struct {
+	Users []User `json:"users"`
+}
+
+func webhookUserFromSession(s Session) *WebhookUser {
+	return &WebhookUser{
+		ID:    s.ID,
+		Email: s.Email,
+		Name:  s.Username,
+	}
 }
 
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryDead      DeliveryStatus = "dead"
+)
+
+// WebhookDelivery is a webhook request kept in the outbox until the receiver
+// accepts it or it runs out of attempts.
+type WebhookDelivery struct {
+	ID             int64            `json:"id"`
+	SubscriptionId string           `json:"subscriptionId"`
+	Action         string           `json:"action"`
+	MessageId      int              `json:"messageId"`
+	URL            string           `json:"url"`
+	Payload        string           `json:"payload"`
+	Status         DeliveryStatus   `json:"status"`
+	Attempts       int              `json:"attempts"`
+	StatusCode     int              `json:"statusCode"`
+	Response       string           `json:"response"`
+	Error          string           `json:"error"`
+	CreatedAt      time.Time        `json:"createdAt"`
+	UpdatedAt      time.Time        `json:"updatedAt"`
+	NextAttemptAt  time.Time        `json:"nextAttemptAt"`
+	History        []WebhookAttempt `json:"history,omitempty"`
+}
+
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode"`
+	Response   string    `json:"response"`
+	Error      string    `json:"error"`
+	Duration   int64     `json:"durationMs"`
+}
+
+var webhookWake = make(chan struct{}, 1)
+
+var webhookClient = &http.Client{
+	Timeout: 5 * time.Second,
+}
+
+var insecureWebhookClient = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	},
+}
+
+// SendWebhook queues a message action, see sendWebhookEvent, and federates it
+// to the ActivityPub followers.
 func SendWebhook(ctx context.Context, action string, message *Message) {
-	if settingConfig.WebhookURL == "" {
+	sendWebhookEvent(ctx, WebhookPayload{
+		Action:  action,
+		Message: message,
+	})
+
+	federateMessage(ctx, action, message.ID)
+}
+
+// sendWebhookEvent stores the webhook in the outbox of every subscription that
+// accepts the action, the worker delivers them.
+func sendWebhookEvent(ctx context.Context, payload WebhookPayload) {
+	dbCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	subscriptions, err := getWebhookSubscriptions(dbCtx)
+	if err != nil {
+		log.Printf("Error getting webhook subscriptions: %v\n", err)
 		return
 	}
 
-	payload := WebhookPayload{
-		Action:      action,
-		Message:     *message,
-		Timestamp:   time.Now(),
-		VerifyToken: settingConfig.VerifyToken,
+	var messageId int
+	switch {
+	case payload.Message != nil:
+		messageId = payload.Message.ID
+	case payload.Reaction != nil:
+		messageId = payload.Reaction.MessageId
+	case payload.Report != nil:
+		messageId = int(payload.Report.MessageId)
+	}
+
+	var queued bool
+	for _, s := range subscriptions {
+		if !s.Accepts(payload.Action) {
+			continue
+		}
+
+		payload.Timestamp = time.Now()
+		payload.VerifyToken = ""
+		if s.ID == defaultWebhookId {
+			payload.VerifyToken = settingConfig.VerifyToken
+		}
+
+		jsonData, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Error converting webhook data to JSON: %v\n", err)
+			return
+		}
+
+		delivery := WebhookDelivery{
+			SubscriptionId: s.ID,
+			Action:         payload.Action,
+			MessageId:      messageId,
+			URL:            s.URL,
+			Payload:        string(jsonData),
+			Status:         DeliveryPending,
+			CreatedAt:      payload.Timestamp,
+			UpdatedAt:      payload.Timestamp,
+			NextAttemptAt:  payload.Timestamp,
+		}
+
+		if err := dbCreateWebhookDelivery(dbCtx, &delivery); err != nil {
+			log.Printf("Error saving webhook delivery: %v\n", err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case webhookWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func webhookWorker() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		processWebhookOutbox()
+
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
 	}
+}
 
-	jsonData, err := json.Marshal(payload)
+func processWebhookOutbox() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ids, err := dbClaimWebhookDeliveries(ctx, time.Now(), webhookLease, webhookBatchSize)
+	cancel()
 	if err != nil {
-		log.Printf("Error converting webhook data to JSON: %v\n", err)
+		log.Printf("Failed to claim webhook deliveries: %v\n", err)
 		return
 	}
 
-	httpCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+
+			d, err := dbGetWebhookDelivery(ctx, id, false)
+			if err != nil {
+				log.Printf("Failed to load webhook delivery %d: %v\n", id, err)
+				return
+			}
+			if d.Status != DeliveryPending {
+				rdb.ZRem(ctx, "webhook:outbox", id)
+				return
+			}
+
+			deliverWebhook(ctx, d)
+		}(id)
+	}
+	wg.Wait()
+
+	if len(ids) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := dbTrimWebhookDeliveries(ctx, webhookKeepDeliveries); err != nil {
+			log.Printf("Failed to trim webhook deliveries: %v\n", err)
+		}
+	}
+}
+
+// deliverWebhook makes one attempt and schedules the next one on failure. The
+// subscription is loaded on every attempt so URL, secret and TLS changes apply
+// to retries too.
+func deliverWebhook(ctx context.Context, d *WebhookDelivery) {
+	// Deliveries queued before subscriptions existed belong to webhook_url.
+	if d.SubscriptionId == "" {
+		d.SubscriptionId = defaultWebhookId
+	}
 
-	req, err := http.NewRequestWithContext(httpCtx, "POST", settingConfig.WebhookURL, bytes.NewBuffer(jsonData))
+	s, err := getWebhookSubscription(ctx, d.SubscriptionId)
 	if err != nil {
-		log.Printf("Error creating webhook request: %v\n", err)
+		log.Printf("Failed to load webhook subscription %s: %v\n", d.SubscriptionId, err)
+		return
+	}
+
+	if s == nil {
+		d.Status = DeliveryDead
+		d.Error = "webhook subscription was removed"
+		d.UpdatedAt = time.Now()
+		if err := dbUpdateWebhookDelivery(ctx, d, nil); err != nil {
+			log.Printf("Failed to save webhook delivery %d: %v\n", d.ID, err)
+		}
 		return
 	}
 
+	d.URL = s.URL
+	attempt := postWebhook(ctx, s, d)
+
+	d.Attempts++
+	d.StatusCode = attempt.StatusCode
+	d.Response = attempt.Response
+	d.Error = attempt.Error
+	d.UpdatedAt = attempt.At
+
+	switch {
+	case attempt.Error == "" && attempt.StatusCode >= 200 && attempt.StatusCode < 300:
+		d.Status = DeliveryDelivered
+	case d.Attempts >= webhookMaxAttempts:
+		d.Status = DeliveryDead
+		log.Printf("Webhook delivery %d for action '%s' on message %d failed permanently\n", d.ID, d.Action, d.MessageId)
+	default:
+		d.NextAttemptAt = attempt.At.Add(webhookBackoff(d.Attempts))
+	}
+
+	if err := dbUpdateWebhookDelivery(ctx, d, &attempt); err != nil {
+		log.Printf("Failed to save webhook delivery %d: %v\n", d.ID, err)
+	}
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookRetryBase
+	for i := 1; i < attempts && backoff < webhookRetryMax; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, webhookRetryMax)
+}
+
+func postWebhook(ctx context.Context, s *WebhookSubscription, d *WebhookDelivery) WebhookAttempt {
+	body := []byte(d.Payload)
+	now := time.Now()
+	attempt := WebhookAttempt{At: now}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "TheChannel-Webhook")
+	req.Header.Set("X-Channel-Delivery", strconv.FormatInt(d.ID, 10))
 
-	// Warning! Default is not secure
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+	if signature := webhooksig.SignatureHeaderValue(s.Secrets(now), now.Unix(), body); signature != "" {
+		req.Header.Set(webhooksig.TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set(webhooksig.SignatureHeader, signature)
+	}
+
+	client := webhookClient
+	if s.InsecureSkipVerify {
+		client = insecureWebhookClient
 	}
+
 	resp, err := client.Do(req)
+	attempt.Duration = time.Since(now).Milliseconds()
 	if err != nil {
-		log.Printf("Error sending webhook: %v\n", err)
-		return
+		attempt.Error = err.Error()
+		return attempt
 	}
 	defer resp.Body.Close()
 
-	log.Printf("Sent webhook for action '%s' on message %d. Response code: %d\n",
-		action, message.ID, resp.StatusCode)
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, webhookMaxResponseSize))
+	attempt.StatusCode = resp.StatusCode
+	attempt.Response = string(response)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		attempt.Error = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return attempt
+}
+
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	status := DeliveryStatus(r.URL.Query().Get("status"))
+
+	deliveries, err := dbGetWebhookDeliveries(ctx, status, limit)
+	if err != nil {
+		log.Printf("Error retrieving webhook deliveries: %v\n", err)
+		http.Error(w, "Error retrieving webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func getWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	d, err := dbGetWebhookDelivery(ctx, id, true)
+	if err == redis.Nil {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving webhook delivery", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// redeliverWebhook puts a delivery back in the outbox with a fresh set of
+// attempts. Its attempt log is kept.
+func redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	d, err := dbGetWebhookDelivery(ctx, id, false)
+	if err == redis.Nil {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving webhook delivery", http.StatusInternalServerError)
+		return
+	}
+
+	d.Status = DeliveryPending
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now()
+	d.UpdatedAt = d.NextAttemptAt
+
+	if err := dbUpdateWebhookDelivery(ctx, d, nil); err != nil {
+		http.Error(w, "Error saving webhook delivery", http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
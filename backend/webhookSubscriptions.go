@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// defaultWebhookId identifies the subscription built from the webhook_url
+// setting, which keeps working next to the managed subscriptions.
+const defaultWebhookId = "default"
+
+// webhookSubscriptionsMu serializes the read-modify-write of the stored
+// subscriptions list, so concurrent admin changes do not drop each other.
+var webhookSubscriptionsMu sync.Mutex
+
+var webhookEvents = []string{
+	WebhookCreate,
+	WebhookUpdate,
+	WebhookDelete,
+	WebhookReaction,
+	WebhookReport,
+	WebhookLogin,
+	WebhookSettings,
+	WebhookPrivileges,
+}
+
+type WebhookSubscription struct {
+	ID                  string    `json:"id"`
+	Name                string    `json:"name"`
+	URL                 string    `json:"url"`
+	Secret              string    `json:"secret"`
+	PreviousSecret      string    `json:"previousSecret"`
+	PreviousSecretUntil time.Time `json:"previousSecretUntil"`
+	Events              []string  `json:"events"` // empty means every event
+	InsecureSkipVerify  bool      `json:"insecureSkipVerify"`
+	Enabled             bool      `json:"enabled"`
+	CreatedAt           time.Time `json:"createdAt"`
+}
+
+// Secrets returns the secrets webhooks are currently signed with. The previous
+// secret is kept until its grace period ends so receivers can rotate.
+func (s *WebhookSubscription) Secrets(now time.Time) []string {
+	secrets := []string{s.Secret}
+	if s.PreviousSecret != "" && now.Before(s.PreviousSecretUntil) {
+		secrets = append(secrets, s.PreviousSecret)
+	}
+
+	return secrets
+}
+
+// withoutSecrets returns a copy that is safe to send back to the admin. The
+// secret is only shown once, in the response that created the subscription.
+func (s *WebhookSubscription) withoutSecrets() *WebhookSubscription {
+	c := *s
+	c.Secret = ""
+	c.PreviousSecret = ""
+	return &c
+}
+
+func (s *WebhookSubscription) Accepts(action string) bool {
+	return s.Enabled && (len(s.Events) == 0 || slices.Contains(s.Events, action))
+}
+
+func (s *WebhookSubscription) IsValid() bool {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+
+	for _, event := range s.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func defaultWebhookSubscription() *WebhookSubscription {
+	if settingConfig.WebhookURL == "" {
+		return nil
+	}
+
+	return &WebhookSubscription{
+		ID:                  defaultWebhookId,
+		URL:                 settingConfig.WebhookURL,
+		Secret:              settingConfig.WebhookSecret,
+		PreviousSecret:      settingConfig.WebhookPreviousSecret,
+		PreviousSecretUntil: settingConfig.WebhookPreviousUntil,
+		Events:              settingConfig.WebhookEvents,
+		InsecureSkipVerify:  settingConfig.WebhookSkipTLSVerify,
+		Enabled:             true,
+	}
+}
+
+// getWebhookSubscriptions returns the managed subscriptions followed by the
+// one from the webhook_url setting, if set.
+func getWebhookSubscriptions(ctx context.Context) ([]*WebhookSubscription, error) {
+	subscriptions, err := dbGetWebhookSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if s := defaultWebhookSubscription(); s != nil {
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, nil
+}
+
+func getWebhookSubscription(ctx context.Context, id string) (*WebhookSubscription, error) {
+	subscriptions, err := getWebhookSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range subscriptions {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func getWebhooksList(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	subscriptions, err := dbGetWebhookSubscriptions(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get webhooks list", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]*WebhookSubscription, len(subscriptions))
+	for i, s := range subscriptions {
+		list[i] = s.withoutSecrets()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// setWebhook creates a subscription when the ID is empty and replaces the
+// existing one otherwise. A new subscription without a secret gets a generated
+// one, which is returned this once; an update without one keeps the secrets
+// it had and never returns them.
+func setWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	var req WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !req.IsValid() {
+		http.Error(w, "Invalid webhook URL or events", http.StatusBadRequest)
+		return
+	}
+
+	webhookSubscriptionsMu.Lock()
+	defer webhookSubscriptionsMu.Unlock()
+
+	subscriptions, err := dbGetWebhookSubscriptions(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get webhooks list", http.StatusInternalServerError)
+		return
+	}
+
+	response := &req
+	if req.ID == "" {
+		if req.Secret == "" {
+			req.Secret = generatedRandomID(32)
+		}
+		req.ID = generatedRandomID(8)
+		req.CreatedAt = time.Now()
+		subscriptions = append(subscriptions, &req)
+	} else {
+		i := slices.IndexFunc(subscriptions, func(s *WebhookSubscription) bool { return s.ID == req.ID })
+		if i == -1 {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		existing := subscriptions[i]
+		if req.Secret == "" {
+			req.Secret = existing.Secret
+		}
+		if req.PreviousSecret == "" {
+			req.PreviousSecret = existing.PreviousSecret
+			req.PreviousSecretUntil = existing.PreviousSecretUntil
+		}
+		req.CreatedAt = existing.CreatedAt
+		subscriptions[i] = &req
+		response = req.withoutSecrets()
+	}
+
+	if err := dbSetWebhookSubscriptions(ctx, subscriptions); err != nil {
+		http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id := chi.URLParam(r, "id")
+
+	webhookSubscriptionsMu.Lock()
+	defer webhookSubscriptionsMu.Unlock()
+
+	subscriptions, err := dbGetWebhookSubscriptions(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get webhooks list", http.StatusInternalServerError)
+		return
+	}
+
+	subscriptions = slices.DeleteFunc(subscriptions, func(s *WebhookSubscription) bool { return s.ID == id })
+
+	if err := dbSetWebhookSubscriptions(ctx, subscriptions); err != nil {
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{Success: true}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,120 @@
+// Package webhooksig signs and verifies TheChannel webhook requests.
+//
+// Every webhook carries two headers: X-Channel-Timestamp with the Unix time the
+// request was sent, and X-Channel-Signature with one or more comma separated
+// "sha256=<hex>" values. Each value is an HMAC-SHA256 of "<timestamp>.<body>"
+// keyed with a webhook secret. While a secret is being rotated the request is
+// signed with both the new and the previous secret, so a receiver configured
+// with either one keeps working.
+//
+// The package only depends on the standard library, receivers written in Go
+// can copy it as is.
+package webhooksig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Channel-Signature"
+	TimestampHeader = "X-Channel-Timestamp"
+
+	// DefaultTolerance is how old a request may be before it is rejected as a
+	// possible replay.
+	DefaultTolerance = 5 * time.Minute
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	ErrMissingHeaders   = errors.New("webhooksig: missing signature headers")
+	ErrInvalidTimestamp = errors.New("webhooksig: invalid timestamp")
+	ErrExpired          = errors.New("webhooksig: timestamp outside tolerance")
+	ErrNoMatch          = errors.New("webhooksig: no matching signature")
+)
+
+// Sign returns the signature of body for the given secret and timestamp,
+// including the "sha256=" prefix.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureHeaderValue signs body with every non-empty secret and joins the
+// results into a single header value.
+func SignatureHeaderValue(secrets []string, timestamp int64, body []byte) string {
+	signatures := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret != "" {
+			signatures = append(signatures, Sign(secret, timestamp, body))
+		}
+	}
+
+	return strings.Join(signatures, ",")
+}
+
+// Verify checks the signature and timestamp header values against body. It
+// succeeds when any signature in the header matches any of the secrets.
+func Verify(signature, timestamp string, body []byte, tolerance time.Duration, now time.Time, secrets ...string) error {
+	if signature == "" || timestamp == "" {
+		return ErrMissingHeaders
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	if tolerance > 0 {
+		age := now.Sub(time.Unix(ts, 0))
+		if age > tolerance || age < -tolerance {
+			return ErrExpired
+		}
+	}
+
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		expected := Sign(secret, ts, body)
+		for _, candidate := range strings.Split(signature, ",") {
+			if hmac.Equal([]byte(strings.TrimSpace(candidate)), []byte(expected)) {
+				return nil
+			}
+		}
+	}
+
+	return ErrNoMatch
+}
+
+// VerifyRequest reads and verifies the body of an incoming webhook request.
+// The body is returned so the caller can decode it, and r.Body is replaced so
+// it can be read again.
+func VerifyRequest(r *http.Request, tolerance time.Duration, secrets ...string) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	err = Verify(r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), body, tolerance, time.Now(), secrets...)
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
@@ -0,0 +1,123 @@
+package webhooksig
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"action":"new-message","message":{"id":1}}`)
+	now := time.Unix(1714557600, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	signature := Sign("secret", now.Unix(), body)
+
+	if !strings.HasPrefix(signature, "sha256=") || len(signature) != len("sha256=")+64 {
+		t.Fatalf("Sign = %q", signature)
+	}
+	if signature != Sign("secret", now.Unix(), body) {
+		t.Error("Sign is not deterministic")
+	}
+
+	tests := []struct {
+		name      string
+		signature string
+		timestamp string
+		body      []byte
+		secrets   []string
+		want      error
+	}{
+		{name: "round trip", signature: signature, timestamp: ts, body: body, secrets: []string{"secret"}},
+		{name: "tampered body", signature: signature, timestamp: ts, body: []byte(`{"action":"new-message","message":{"id":2}}`), secrets: []string{"secret"}, want: ErrNoMatch},
+		{name: "tampered timestamp", signature: signature, timestamp: strconv.FormatInt(now.Unix()+1, 10), body: body, secrets: []string{"secret"}, want: ErrNoMatch},
+		{name: "other secret", signature: signature, timestamp: ts, body: body, secrets: []string{"other"}, want: ErrNoMatch},
+		{name: "empty secret never matches", signature: Sign("", now.Unix(), body), timestamp: ts, body: body, secrets: []string{""}, want: ErrNoMatch},
+		{name: "missing signature", timestamp: ts, body: body, secrets: []string{"secret"}, want: ErrMissingHeaders},
+		{name: "missing timestamp", signature: signature, body: body, secrets: []string{"secret"}, want: ErrMissingHeaders},
+		{name: "invalid timestamp", signature: signature, timestamp: "yesterday", body: body, secrets: []string{"secret"}, want: ErrInvalidTimestamp},
+	}
+	for _, tt := range tests {
+		err := Verify(tt.signature, tt.timestamp, tt.body, DefaultTolerance, now, tt.secrets...)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	body := []byte(`{}`)
+	sent := time.Unix(1714557600, 0)
+	signature := Sign("secret", sent.Unix(), body)
+	ts := strconv.FormatInt(sent.Unix(), 10)
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		tolerance time.Duration
+		want      error
+	}{
+		{name: "just in time", now: sent.Add(DefaultTolerance), tolerance: DefaultTolerance},
+		{name: "too old", now: sent.Add(DefaultTolerance + time.Second), tolerance: DefaultTolerance, want: ErrExpired},
+		{name: "from the future", now: sent.Add(-DefaultTolerance - time.Second), tolerance: DefaultTolerance, want: ErrExpired},
+		{name: "clock skew within tolerance", now: sent.Add(-time.Minute), tolerance: DefaultTolerance},
+		{name: "no tolerance skips the check", now: sent.Add(24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		if err := Verify(signature, ts, body, tt.tolerance, tt.now, "secret"); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	body := []byte(`{"action":"delete-message"}`)
+	now := time.Unix(1714557600, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	header := SignatureHeaderValue([]string{"new", "", "old"}, now.Unix(), body)
+	if got := strings.Split(header, ","); len(got) != 2 || got[0] != Sign("new", now.Unix(), body) || got[1] != Sign("old", now.Unix(), body) {
+		t.Fatalf("SignatureHeaderValue = %q", header)
+	}
+
+	for _, secrets := range [][]string{{"new"}, {"old"}, {"other", "old"}, {"", "new"}} {
+		if err := Verify(header, ts, body, DefaultTolerance, now, secrets...); err != nil {
+			t.Errorf("receiver with %q: %v", secrets, err)
+		}
+	}
+	if err := Verify(header, ts, body, DefaultTolerance, now, "other"); !errors.Is(err, ErrNoMatch) {
+		t.Errorf("receiver with another secret: got %v, want %v", err, ErrNoMatch)
+	}
+
+	// receivers may see the values with spaces after the commas
+	spaced := strings.ReplaceAll(header, ",", ", ")
+	if err := Verify(spaced, ts, body, DefaultTolerance, now, "old"); err != nil {
+		t.Errorf("spaced header: %v", err)
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`{"action":"new-message"}`)
+	now := time.Now()
+
+	r := httptest.NewRequest("POST", "/hook", bytes.NewReader(body))
+	r.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	r.Header.Set(SignatureHeader, SignatureHeaderValue([]string{"secret"}, now.Unix(), body))
+
+	got, err := VerifyRequest(r, DefaultTolerance, "secret")
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("VerifyRequest = %s, %v", got, err)
+	}
+	if again, _ := io.ReadAll(r.Body); !bytes.Equal(again, body) {
+		t.Errorf("body read again = %s", again)
+	}
+
+	r = httptest.NewRequest("POST", "/hook", bytes.NewReader(body))
+	if _, err := VerifyRequest(r, DefaultTolerance, "secret"); !errors.Is(err, ErrMissingHeaders) {
+		t.Errorf("unsigned request: got %v, want %v", err, ErrMissingHeaders)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait     = 10 * time.Second
+	wsPongWait      = 60 * time.Second
+	wsPingPeriod    = 50 * time.Second
+	wsMaxReadSize   = 1024
+	wsCatchUpLength = 100
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// WsRequest is a message sent by the client over the socket.
+// "catch-up" asks for the messages published after LastMessageId.
+type WsRequest struct {
+	Type          string `json:"type"`
+	LastMessageId int    `json:"lastMessageId"`
+}
+
+func getWsEvents(w http.ResponseWriter, r *http.Request) {
+	isAdmin := checkPrivilege(r, Writer)
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	clientCtx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	client, replay, lastEventId, err := subscribeEvents(clientCtx, r.URL.Query().Get("lastEventId"), isAdmin)
+	if err != nil {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "error"), time.Now().Add(wsWriteWait))
+		return
+	}
+	defer eventHub.Unsubscribe(client)
+
+	catchUp := make(chan int, 1)
+	if lastMessageId, err := strconv.Atoi(r.URL.Query().Get("lastMessageId")); err == nil && lastMessageId > 0 {
+		catchUp <- lastMessageId
+	}
+
+	go wsReadLoop(conn, catchUp, cancel)
+
+	for _, event := range replay {
+		if err := wsWriteEvent(conn, event.Data); err != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-clientCtx.Done():
+			return
+
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+
+		case lastMessageId := <-catchUp:
+			if err := wsCatchUp(clientCtx, conn, lastMessageId, isAdmin); err != nil {
+				return
+			}
+
+		case event, ok := <-client.Events:
+			if !ok {
+				return
+			}
+			if !eventIdAfter(event.ID, lastEventId) {
+				continue
+			}
+			if err := wsWriteEvent(conn, event.Data); err != nil {
+				return
+			}
+			lastEventId = event.ID
+		}
+	}
+}
+
+// wsReadLoop handles pongs and client requests. It cancels the connection
+// context when the client goes away or stops answering pings.
+func wsReadLoop(conn *websocket.Conn, catchUp chan int, cancel context.CancelFunc) {
+	defer cancel()
+
+	conn.SetReadLimit(wsMaxReadSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req WsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			continue
+		}
+
+		if req.Type == "catch-up" && req.LastMessageId > 0 {
+			select {
+			case catchUp <- req.LastMessageId:
+			default:
+			}
+		}
+	}
+}
+
+func wsWriteEvent(conn *websocket.Conn, data []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// wsCatchUp sends the messages published after lastMessageId as new-message
+// events, oldest first.
+func wsCatchUp(ctx context.Context, conn *websocket.Conn, lastMessageId int, isAdmin bool) error {
+	queryCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	page, err := dbGetMessagePage(queryCtx, pageAfter, lastMessageId, time.Time{}, wsCatchUpLength, isAdmin, settingConfig.CountViews)
+	if err != nil {
+		log.Printf("Failed to get messages for catch-up: %v\n", err)
+		return nil
+	}
+
+	messages := page.Messages
+	slices.Reverse(messages)
+	for _, m := range messages {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteJSON(PushMessage{Type: "new-message", M: m}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -10,6 +10,11 @@ export const routes: Routes = [
     component: ChannelComponent,
     canActivate: [AuthGuard],
   },
+  {
+    path: 'message/:id',
+    component: ChannelComponent,
+    canActivate: [AuthGuard],
+  },
   {
     path: '**',
     redirectTo: ''
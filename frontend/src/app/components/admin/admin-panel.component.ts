@@ -6,6 +6,7 @@ import { PrivilegDashboardComponent } from "./privileg-dashboard/privileg-dashbo
 import { ChannelInfoFormComponent } from "../channel/channel-info-form/channel-info-form.component";
 import { ReportsComponent } from "./reports/reports.component";
 import { StatisticsComponent } from "./statistics/statistics.component";
+import { TrashComponent } from "./trash/trash.component";
 
 @Component({
   selector: 'admin-dashboard',
@@ -19,7 +20,8 @@ import { StatisticsComponent } from "./statistics/statistics.component";
     PrivilegDashboardComponent,
     ChannelInfoFormComponent,
     ReportsComponent,
-    StatisticsComponent
+    StatisticsComponent,
+    TrashComponent
 ],
   templateUrl: './admin-panel.component.html',
   styleUrls: ['./admin-panel.component.scss']
@@ -34,6 +36,7 @@ export class AdminPanelComponent implements OnInit {
   readonly closedReports = "closed-reports";
   readonly allReports = "all-reports";
   readonly statistics = "statistics";
+  readonly trash = "trash";
 
   selectedMenuItem = this.info;
 
@@ -55,6 +58,10 @@ export class AdminPanelComponent implements OnInit {
       title: 'סטטיסטיקות',
       icon: 'bar-chart-outline',
     },
+    {
+      title: 'הודעות שנמחקו',
+      icon: 'trash-2-outline',
+    },
     {
       title: "אימוג'ים",
       icon: 'smiling-face-outline',
@@ -117,6 +124,9 @@ export class AdminPanelComponent implements OnInit {
         case 'bar-chart-outline':
           this.selectedMenuItem = this.statistics;
           break;
+        case 'trash-2-outline':
+          this.selectedMenuItem = this.trash;
+          break;
       }
     });
   }
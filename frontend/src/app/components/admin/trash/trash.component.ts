@@ -0,0 +1,81 @@
+import { Component, OnInit } from '@angular/core';
+import { NbButtonModule, NbCardModule, NbListModule, NbToastrService } from "@nebular/theme";
+import { MarkdownComponent } from 'ngx-markdown';
+import { AdminService } from '../../../services/admin.service';
+import { AuthService } from '../../../services/auth.service';
+import { ChatMessage } from '../../../services/chat.service';
+import { MessageTimePipe } from "../../../pipes/message-time.pipe";
+
+@Component({
+  selector: 'app-trash',
+  imports: [
+    NbCardModule,
+    NbButtonModule,
+    NbListModule,
+    MarkdownComponent,
+    MessageTimePipe
+  ],
+  templateUrl: './trash.component.html',
+  styleUrl: './trash.component.scss'
+})
+export class TrashComponent implements OnInit {
+  readonly pageSize = 20;
+
+  messages: ChatMessage[] = [];
+  total: number = 0;
+  isLoading: boolean = false;
+
+  constructor(
+    private adminService: AdminService,
+    private authService: AuthService,
+    private toastrService: NbToastrService
+  ) { }
+
+  // purging cannot be undone, so it is left to moderators
+  get canPurge(): boolean {
+    return !!this.authService.userInfo?.privileges?.['moderator'];
+  }
+
+  ngOnInit(): void {
+    this.loadMore();
+  }
+
+  loadMore() {
+    this.isLoading = true;
+    this.adminService.getDeletedMessages(this.messages.length, this.pageSize)
+      .then(res => {
+        this.messages = [...this.messages, ...res.messages];
+        this.total = res.total;
+      })
+      .catch(() => this.toastrService.danger('', 'שגיאה בטעינת ההודעות שנמחקו'))
+      .finally(() => this.isLoading = false);
+  }
+
+  restore(message: ChatMessage) {
+    if (!message.id) return;
+
+    this.adminService.restoreDeletedMessage(message.id)
+      .then(() => {
+        this.toastrService.success('', 'ההודעה שוחזרה');
+        this.remove(message);
+      })
+      .catch(() => this.toastrService.danger('', 'שגיאה בשחזור ההודעה'));
+  }
+
+  purge(message: ChatMessage) {
+    if (!message.id) return;
+    if (!window.confirm('למחוק את ההודעה לצמיתות? לא ניתן לבטל פעולה זו')) return;
+
+    this.adminService.purgeMessage(message.id)
+      .then(() => {
+        this.toastrService.success('', 'ההודעה נמחקה לצמיתות');
+        this.remove(message);
+      })
+      .catch(() => this.toastrService.danger('', 'שגיאה במחיקת ההודעה'));
+  }
+
+  private remove(message: ChatMessage) {
+    this.messages = this.messages.filter(m => m.id !== message.id);
+    this.total--;
+  }
+}
@@ -13,7 +13,7 @@ import {
 } from "@nebular/theme";
 import { MessageComponent } from "./message/message.component";
 import { firstValueFrom, interval } from 'rxjs';
-import { ChatMessage, ChatService } from '../../../services/chat.service';
+import { ChatMessage, ChatService, MessagePageQuery } from '../../../services/chat.service';
 import { AuthService } from '../../../services/auth.service';
 import { ActivatedRoute } from '@angular/router';
 import { NotificationsService } from '../../../services/notifications.service';
@@ -57,7 +57,6 @@ export class ChatComponent implements OnInit, OnDestroy {
   hideScheduledMessages: boolean = false;
   userInfo?: User;
   isLoading: boolean = false;
-  offset: number = 0;
   limit: number = 20;
   hasOldMessages: boolean = true;
   hasNewMessages: boolean = false;
@@ -66,6 +65,8 @@ export class ChatComponent implements OnInit, OnDestroy {
   private lastHeartbeat: number = Date.now();
   private subLastHeartbeat: any;
   lastReadMessageId: number = 0;
+  pinnedMessages: ChatMessage[] = [];
+  pinnedIndex: number = 0;
 
   constructor(
     private chatService: ChatService,
@@ -125,6 +126,11 @@ export class ChatComponent implements OnInit, OnDestroy {
           this.scrollToId({ messageId: messageId, mark: true });
         }
       });
+      this.router.paramMap.subscribe(params => {
+        const messageId = Number(params.get('id'));
+        if (!messageId || !Number.isInteger(messageId)) return;
+        this.scrollToId({ messageId: messageId, mark: true });
+      });
     }, 800);
   }
 
@@ -133,6 +139,7 @@ export class ChatComponent implements OnInit, OnDestroy {
 
     this.initializeMessageListener();
     this.keepAliveSSE();
+    this.loadPinnedMessages();
 
     this._authService.loadUserInfo().then((res) => {
       this.userInfo = res;
@@ -180,6 +187,7 @@ export class ChatComponent implements OnInit, OnDestroy {
           });
           break;
         case 'delete-message':
+          this.zone.run(() => this.updateReplyPreviews(message.message));
           if (this.userInfo?.privileges?.['writer']) {
             this.zone.run(() => {
               const index = this.messages.findIndex(m => m.id === message.message.id);
@@ -194,9 +202,18 @@ export class ChatComponent implements OnInit, OnDestroy {
             this.messages = this.messages.filter(m => m.id !== message.message.id);
           });
           break;
+        case 'purge-message':
+          this.zone.run(() => {
+            this.messages = this.messages.filter(m => m.id !== message.message.id);
+            this.updatePinnedMessage(message.message);
+          });
+          break;
         case 'edit-message':
           this.zone.run(() => {
             const index = this.messages.findIndex(m => m.id === message.message.id);
+            this.updateReplyPreviews(message.message);
+            const pinned = this.pinnedMessages.find(m => m.id === message.message.id);
+            if (pinned) pinned.text = message.message.text;
             if (index !== -1) {
               this.messages[index] = message.message;
             } else {
@@ -205,6 +222,10 @@ export class ChatComponent implements OnInit, OnDestroy {
             }
           });
           break;
+        case 'pin':
+        case 'unpin':
+          this.zone.run(() => this.updatePinnedMessage(message.message));
+          break;
         case 'reaction':
           this.zone.run(() => {
             const index = this.messages.findIndex(m => m.id === message.message.id);
@@ -218,6 +239,49 @@ export class ChatComponent implements OnInit, OnDestroy {
     };
   }
 
+  async loadPinnedMessages() {
+    try {
+      this.pinnedMessages = await firstValueFrom(this.chatService.getPinnedMessages());
+      this.pinnedIndex = 0;
+    } catch (error) {
+      console.error('שגיאה בטעינת הודעות נעוצות:', error);
+    }
+  }
+
+  private updatePinnedMessage(message: ChatMessage) {
+    this.pinnedMessages = this.pinnedMessages.filter(m => m.id !== message.id);
+    if (message.pinned) {
+      this.pinnedMessages.unshift(message);
+      this.pinnedMessages.sort((a, b) => new Date(b.pinnedAt!).getTime() - new Date(a.pinnedAt!).getTime());
+    }
+    this.pinnedIndex = Math.min(this.pinnedIndex, Math.max(this.pinnedMessages.length - 1, 0));
+
+    const m = this.messages.find(m => m.id === message.id);
+    if (m) {
+      m.pinned = message.pinned;
+      m.pinnedAt = message.pinnedAt;
+      m.pinExpiresAt = message.pinExpiresAt;
+    }
+  }
+
+  // Each click shows the next pinned message, like a carousel.
+  showPinnedMessage() {
+    const message = this.pinnedMessages[this.pinnedIndex];
+    if (!message) return;
+    this.scrollToId({ messageId: message.id!, smooth: true, mark: true });
+    this.pinnedIndex = (this.pinnedIndex + 1) % this.pinnedMessages.length;
+  }
+
+  // Replies show a preview of the original, which follows its edits and deletion.
+  private updateReplyPreviews(original: ChatMessage) {
+    const text = original.text?.replaceAll(/\n/g, ' ').replaceAll('*', '').slice(0, 100) || '';
+    this.messages.forEach(m => {
+      if (m.replyTo === original.id) {
+        m.reply = { id: original.id!, text: original.deleted ? '' : text, deleted: original.deleted };
+      }
+    });
+  }
+
   ngOnDestroy() {
     this.chatService.sseClose();
     clearInterval(this.subLastHeartbeat);
@@ -261,60 +325,42 @@ export class ChatComponent implements OnInit, OnDestroy {
   }
 
   async loadMessages(opt: LoadMsgOpt = {}) {
-    if (this.isLoading || (opt.scrollDown && !this.hasNewMessages) || (!opt.scrollDown && !this.hasOldMessages)) return;
-
-    let startId: number;
-    let resetList: boolean = opt.resetList || false;
-    let direction: string = "desc";
+    if (this.isLoading) return;
+    if (opt.scrollDown && !this.hasNewMessages) return;
+    if (!opt.scrollDown && !opt.messageId && !opt.resetList && !this.hasOldMessages) return;
 
-    opt.resetList && (this.offset = 0);
+    const newestId = this.messages[0]?.id;
+    const oldestId = this.messages[this.messages.length - 1]?.id;
 
-    const maxId = Math.max(...this.messages.map(m => m.id!));
-    if (opt.scrollDown) {
-      direction = "asc";
-      startId = maxId;
-    } else {
-      if (opt.messageId) {
-        if (opt.messageId > maxId + this.limit) {
-          resetList = true;
-          this.hasNewMessages = true;
-          this.hasOldMessages = true;
-          startId = opt.messageId + 10;
-          direction = "asc";
-          opt.scrollDown = true;
-        } else if (opt.messageId > maxId) {
-          startId = maxId;
-          direction = "asc";
-          opt.scrollDown = true;
-        } else {
-          if (opt.messageId < this.offset - this.limit) {
-            resetList = true;
-            this.hasNewMessages = true;
-            this.hasOldMessages = true;
-            startId = opt.messageId + 10;
-          } else {
-            startId = this.offset;
-          }
-        }
-      } else {
-        startId = this.offset;
-      }
+    // a message that is not loaded is shown with the messages around it
+    let query: MessagePageQuery = {};
+    let resetList = opt.resetList || !this.messages.length;
+    if (opt.messageId) {
+      query = { around: opt.messageId };
+      resetList = true;
+    } else if (opt.scrollDown) {
+      query = { after: newestId };
+    } else if (!resetList) {
+      query = { before: oldestId };
     }
 
     try {
       this.isLoading = true;
-      const response = await firstValueFrom(this.chatService.getMessages(startId, this.limit, direction))
-      if (response) {
-        if (opt.scrollDown) {
-          resetList ? this.messages = response.reverse() : this.messages.unshift(...response.reverse());
-          this.hasNewMessages = response.length >= this.limit;
-        } else {
-          resetList ? this.messages = response : this.messages.push(...response);
-          this.hasOldMessages = response.length >= this.limit;
-        }
-        this.offset = Math.min(...this.messages.map(m => m.id!));
+      const page = await firstValueFrom(this.chatService.getMessages(query, this.limit));
+      if (resetList) {
+        this.messages = page.messages;
+        this.hasOldMessages = page.hasMoreBefore;
+        this.hasNewMessages = page.hasMoreAfter;
+      } else if (opt.scrollDown) {
+        this.messages.unshift(...page.messages);
+        this.hasNewMessages = page.hasMoreAfter;
+      } else {
+        this.messages.push(...page.messages);
+        this.hasOldMessages = page.hasMoreBefore;
+      }
+      if (opt.messageId && page.anchor) {
         setTimeout(() => {
-          opt.messageId && this.scrollToId({ messageId: opt.messageId, smooth: false, mark: opt.mark });
+          this.scrollToId({ messageId: opt.messageId!, smooth: false, mark: opt.mark });
         }, 300);
       }
     } catch (error) {
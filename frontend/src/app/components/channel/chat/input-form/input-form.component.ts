@@ -19,7 +19,7 @@ import {
 } from "@nebular/theme";
 import { MarkdownComponent } from "ngx-markdown";
 import { NgIconsModule } from "@ng-icons/core";
-import { Attachment, ChatFile, ChatMessage } from '../../../../services/chat.service';
+import { Attachment, ChatFile, ChatMessage, ReplyPreview } from '../../../../services/chat.service';
 import { AdminService, EditMsg } from '../../../../services/admin.service';
 import { AutosizeModule } from "ngx-autosize";
 import { TimePickerComponent } from './time-picker/time-picker.component';
@@ -55,6 +55,7 @@ export class InputFormComponent implements OnInit, OnDestroy {
 
   input: string = '';
   isAds: boolean = false;
+  reply?: ReplyPreview;
   schedulingMessage: Date | undefined = undefined;
   isSending: boolean = false;
   showMarkdownPreview: boolean = false;
@@ -81,11 +82,17 @@ export class InputFormComponent implements OnInit, OnDestroy {
         this.schedulingMessage = edit.message?.timestamp;
       }
       if (edit?.new) {
-        this.input = this.input ? `${this.input}\n${edit.message.text}` : edit.message.text || '';
+        if (edit.message.reply) {
+          this.reply = edit.message.reply;
+        }
+        if (edit.message.text) {
+          this.input = this.input ? `${this.input}\n${edit.message.text}` : edit.message.text;
+        }
       } else {
         this.message = edit?.message;
         this.input = this.message?.text || '';
         this.isAds = this.message?.is_ads || false;
+        this.reply = this.message?.reply;
       }
     });
   }
@@ -187,8 +194,12 @@ export class InputFormComponent implements OnInit, OnDestroy {
 
       this.toastrService.success("", "הודעה פורסמה בהצלחה");
       this.clearInputs();
-    } catch (error) {
-      this.toastrService.danger("", "שגיאה בפרסום הודעה");
+    } catch (error: any) {
+      if (error?.status === 412) {
+        this.toastrService.danger("", "ההודעה נערכה בינתיים על ידי משתמש אחר, יש לפתוח אותה לעריכה מחדש");
+      } else {
+        this.toastrService.danger("", "שגיאה בפרסום הודעה");
+      }
     } finally {
       this.isSending = false
     }
@@ -199,6 +210,7 @@ export class InputFormComponent implements OnInit, OnDestroy {
     this.message.text = this.input;
     this.message.deleted = false;
     this.message.is_ads = this.isAds;
+    this.message.replyTo = this.reply?.id;
     await firstValueFrom(this.adminService.editMessage(this.message));
     this.cancelUpdateMessage();
     return true;
@@ -216,6 +228,7 @@ export class InputFormComponent implements OnInit, OnDestroy {
       file: undefined,
       is_ads: this.isAds,
       timestamp: this.schedulingMessage || undefined,
+      replyTo: this.reply?.id,
     };
 
     try {
@@ -223,6 +236,7 @@ export class InputFormComponent implements OnInit, OnDestroy {
         this.message.text = this.input;
         this.message.is_ads = this.isAds;
         this.message.timestamp = this.schedulingMessage;
+        this.message.replyTo = this.reply?.id;
 
         await this.adminService.editScheduledMessage(this.message);
       } else {
@@ -242,6 +256,7 @@ export class InputFormComponent implements OnInit, OnDestroy {
       text: this.input,
       file: undefined,
       is_ads: this.isAds,
+      replyTo: this.reply?.id,
     };
 
     this.message = await firstValueFrom(this.adminService.addMessage(newMessage));
@@ -258,6 +273,7 @@ export class InputFormComponent implements OnInit, OnDestroy {
     this.attachments = [];
     this.message = undefined;
     this.isAds = false;
+    this.reply = undefined;
     this.schedulingMessage = undefined;
     this.adminService.setEditMessage(undefined);
   }
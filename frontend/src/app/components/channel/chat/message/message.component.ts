@@ -14,10 +14,11 @@ import Viewer from 'viewerjs';
 import { YoutubePlayerComponent } from '../youtube-player/youtube-player.component';
 import { NgbPopover, NgbPopoverModule } from '@ng-bootstrap/ng-bootstrap';
 import { MessageTimePipe } from '../../../../pipes/message-time.pipe';
-import { ChatMessage, ChatService } from '../../../../services/chat.service';
+import { ChatMessage, ChatService, ReplyPreview } from '../../../../services/chat.service';
 import { AdminService } from '../../../../services/admin.service';
 import { AuthService } from '../../../../services/auth.service';
 import { ReportComponent } from './report/report.component';
+import { RevisionsComponent } from './revisions/revisions.component';
 @Component({
   selector: 'app-message',
   imports: [
@@ -161,6 +162,18 @@ export class MessageComponent implements OnInit, AfterViewInit, OnDestroy {
     }
   }
 
+  openRevisionsDialog(messageId?: number, version?: number) {
+    if (this.isSchedulingMessage || !this._authService.userInfo?.privileges?.['writer']) return;
+    this.dialogService.open(RevisionsComponent, { closeOnBackdropClick: true, context: { messageId, version } });
+  }
+
+  togglePin(message: ChatMessage) {
+    const request = message.pinned ? this._adminService.unpinMessage(message.id) : this._adminService.pinMessage(message.id);
+    request.subscribe({
+      error: () => this.toastrService.danger('', 'שגיאה בהצמדת ההודעה'),
+    });
+  }
+
   openReportDialog(messageId?: number) {
     if (this.isSchedulingMessage) return;
     this.dialogService.open(ReportComponent, { closeOnBackdropClick: true, context: { messageId } });
@@ -191,14 +204,17 @@ export class MessageComponent implements OnInit, AfterViewInit, OnDestroy {
       newMsgText += '...';
     }
 
+    const reply: ReplyPreview = { id: message.id!, text: newMsgText || '' };
     const m = this._adminService.getEditMessage();
     if (m?.new || !m?.message) {
       let newMessage: ChatMessage = {
-        text: `[quote-embedded#](${message.id}@${newMsgText})\n`
+        replyTo: reply.id,
+        reply: reply,
       }
       this._adminService.setEditMessage({ new: true, message: newMessage, isScheduling: this.isSchedulingMessage });
     } else {
-      m.message.text = `[quote-embedded#](${message.id}@${newMsgText})\n${m.message.text}`;
+      m.message.replyTo = reply.id;
+      m.message.reply = reply;
       this._adminService.setEditMessage(m);
     }
   }
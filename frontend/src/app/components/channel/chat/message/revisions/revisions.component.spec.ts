@@ -0,0 +1,23 @@
+import { ComponentFixture, TestBed } from '@angular/core/testing';
+
+import { RevisionsComponent } from './revisions.component';
+
+describe('RevisionsComponent', () => {
+  let component: RevisionsComponent;
+  let fixture: ComponentFixture<RevisionsComponent>;
+
+  beforeEach(async () => {
+    await TestBed.configureTestingModule({
+      imports: [RevisionsComponent]
+    })
+    .compileComponents();
+
+    fixture = TestBed.createComponent(RevisionsComponent);
+    component = fixture.componentInstance;
+    fixture.detectChanges();
+  });
+
+  it('should create', () => {
+    expect(component).toBeTruthy();
+  });
+});
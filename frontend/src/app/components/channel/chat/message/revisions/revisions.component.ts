@@ -0,0 +1,60 @@
+import { Component, OnInit } from '@angular/core';
+import { NbDialogRef, NbCardModule, NbButtonModule, NbListModule, NbToastrService } from '@nebular/theme';
+import { MarkdownComponent } from 'ngx-markdown';
+import { AdminService } from '../../../../../services/admin.service';
+import { MessageRevision } from '../../../../../models/revision.model';
+import { MessageTimePipe } from '../../../../../pipes/message-time.pipe';
+
+@Component({
+  selector: 'app-revisions',
+  imports: [
+    NbCardModule,
+    NbButtonModule,
+    NbListModule,
+    MarkdownComponent,
+    MessageTimePipe
+  ],
+  templateUrl: './revisions.component.html',
+  styleUrl: './revisions.component.scss'
+})
+export class RevisionsComponent implements OnInit {
+  messageId: number | undefined;
+  version: number | undefined;
+  revisions: MessageRevision[] = [];
+  isLoading: boolean = true;
+
+  constructor(
+    public dialogRef: NbDialogRef<RevisionsComponent>,
+    private adminService: AdminService,
+    private toastrService: NbToastrService
+  ) { }
+
+  ngOnInit() {
+    this.messageId = this.dialogRef.componentRef.instance.messageId;
+    this.version = this.dialogRef.componentRef.instance.version;
+    if (!this.messageId) return;
+
+    this.adminService.getMessageRevisions(this.messageId)
+      .then((revisions) => this.revisions = revisions.reverse())
+      .catch(() => this.toastrService.danger('', 'שגיאה בטעינת היסטוריית העריכות'))
+      .finally(() => this.isLoading = false);
+  }
+
+  restore(revision: MessageRevision) {
+    if (!this.messageId) return;
+    if (!window.confirm('לשחזר את ההודעה לגרסה זו?')) return;
+
+    this.adminService.restoreMessageRevision(this.messageId, revision.revision, this.version)
+      .then(() => {
+        this.toastrService.success('', 'ההודעה שוחזרה');
+        this.dialogRef.close();
+      })
+      .catch((error) => {
+        if (error?.status === 412) {
+          this.toastrService.danger('', 'ההודעה נערכה בינתיים על ידי משתמש אחר, יש לפתוח את ההיסטוריה מחדש');
+        } else {
+          this.toastrService.danger('', 'שגיאה בשחזור ההודעה');
+        }
+      });
+  }
+}
@@ -0,0 +1,6 @@
+import { ChatMessage } from "../services/chat.service";
+
+export interface DeletedMessages {
+    messages: ChatMessage[];
+    total: number;
+}
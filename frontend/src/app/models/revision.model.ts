@@ -0,0 +1,12 @@
+import { ChatFile } from '../services/chat.service';
+
+export interface MessageRevision {
+    revision: number;
+    type: string;
+    text: string;
+    file: ChatFile;
+    is_ads: boolean;
+    editorId: string;
+    editor: string;
+    editedAt: Date;
+}
@@ -6,6 +6,8 @@ import { ResponseResult } from '../models/response-result.model';
 import { Setting } from '../models/setting.model';
 import { Reports, Report } from '../models/report.model';
 import { Statistics } from '../models/statistics.model';
+import { MessageRevision } from '../models/revision.model';
+import { DeletedMessages } from '../models/deleted-messages.model';
 
 export interface PrivilegeUser {
   id?: string;
@@ -62,13 +64,43 @@ export class AdminService {
   }
 
   editMessage(message: ChatMessage): Observable<ChatMessage> {
-    return this.http.post<ChatMessage>(`/api/admin/edit-message`, message);
+    const headers = message.version !== undefined ? { 'If-Match': `"${message.version}"` } : undefined;
+    return this.http.post<ChatMessage>(`/api/admin/edit-message`, message, { headers });
+  }
+
+  getMessageRevisions(id: number): Promise<MessageRevision[]> {
+    return firstValueFrom(this.http.get<MessageRevision[]>(`/api/admin/messages/${id}/revisions`));
+  }
+
+  restoreMessageRevision(id: number, revision: number, version?: number): Promise<ChatMessage> {
+    const headers = version !== undefined ? { 'If-Match': `"${version}"` } : undefined;
+    return firstValueFrom(this.http.post<ChatMessage>(`/api/admin/messages/${id}/revisions/${revision}/restore`, {}, { headers }));
+  }
+
+  pinMessage(id: number | undefined, expiresAt?: Date): Observable<ResponseResult> {
+    return this.http.post<ResponseResult>(`/api/admin/messages/${id}/pin`, { expiresAt });
+  }
+
+  unpinMessage(id: number | undefined): Observable<ResponseResult> {
+    return this.http.post<ResponseResult>(`/api/admin/messages/${id}/unpin`, {});
   }
 
   deleteMessage(id: number | undefined): Observable<ChatMessage> {
     return this.http.get<ChatMessage>(`/api/admin/delete-message/${id}`);
   }
 
+  getDeletedMessages(offset: number, limit: number): Promise<DeletedMessages> {
+    return firstValueFrom(this.http.get<DeletedMessages>('/api/admin/messages/deleted', { params: { offset, limit } }));
+  }
+
+  restoreDeletedMessage(id: number): Promise<ChatMessage> {
+    return firstValueFrom(this.http.post<ChatMessage>(`/api/admin/messages/${id}/restore`, {}));
+  }
+
+  purgeMessage(id: number): Promise<ResponseResult> {
+    return firstValueFrom(this.http.post<ResponseResult>(`/api/admin/messages/${id}/purge`, {}));
+  }
+
   uploadFile(formData: FormData) {
     return this.http.post<ChatFile>('/api/admin/upload', formData, {
       reportProgress: true,
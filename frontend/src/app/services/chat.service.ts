@@ -20,9 +20,36 @@ export interface ChatMessage {
   views?: number;
   reactions?: Reactions;
   is_ads?: boolean;
+  version?: number;
+  replyTo?: number;
+  reply?: ReplyPreview;
+  pinned?: boolean;
+  pinnedAt?: Date;
+  pinExpiresAt?: Date;
+  deletedAt?: Date;
 }
 export type ChatResponse = ChatMessage[];
 
+export interface MessagePage {
+  messages: ChatMessage[];
+  hasMoreBefore: boolean;
+  hasMoreAfter: boolean;
+  anchor?: number;
+}
+
+export type MessagePageQuery = {
+  before?: number;
+  after?: number;
+  around?: number;
+  date?: string;
+}
+
+export interface ReplyPreview {
+  id: number;
+  text: string;
+  deleted?: boolean;
+}
+
 export interface ChatFile {
   url: string;
   filename: string;
@@ -56,16 +83,16 @@ export class ChatService {
     return this.http.post<ResponseResult>('/api/admin/edit-channel-info', { name, description, logoUrl });
   }
 
-  getMessages(offset: number, limit: number, direction: string): Observable<ChatResponse> {
-    return this.http.get<ChatResponse>('/api/messages', {
-      params: {
-        offset: offset.toString(),
-        limit: limit.toString(),
-        direction: direction
-      }
+  getMessages(query: MessagePageQuery, limit: number): Observable<MessagePage> {
+    return this.http.get<MessagePage>('/api/messages', {
+      params: { ...query, limit }
     });
   }
 
+  getPinnedMessages(): Observable<ChatResponse> {
+    return this.http.get<ChatResponse>('/api/messages/pinned');
+  }
+
   setReact(messageId: number, react: string) {
     return firstValueFrom(this.http.post<ResponseResult>('/api/reactions/set-reactions', { messageId, emoji: react }));
   }